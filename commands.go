@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+
+	"example.com/m/v2/models"
+)
+
+// runCommand runs a maintenance command instead of the server:
+//
+//	replay [-scoring name]            rebuild points and rankings from the match history
+//	grant -email address -role name  give a user a role, to make the first admin
+//
+// The config command runs before the database is opened, see configCommand.
+func runCommand(ctx context.Context, dbConn *sql.DB, args []string) error {
+	switch args[0] {
+	case "replay":
+		return replay(ctx, dbConn, args[1:])
+	case "grant":
+		return grant(ctx, dbConn, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// replay rebuilds the projections under a scoring rule, which should then be
+// set as SCORING_RULE so new results are scored the same way.
+func replay(ctx context.Context, dbConn *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	scoringName := flags.String("scoring", "default", "scoring rule to replay the history with")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	rule, err := models.ScoringRuleByName(*scoringName)
+	if err != nil {
+		return err
+	}
+
+	projection, err := models.RebuildProjections(ctx, dbConn, rule)
+	if err != nil {
+		return err
+	}
+	for _, standing := range projection.Standings() {
+		fmt.Printf("%d. player %d: %d points (%d wins, %d losses)\n", standing.Ranking, standing.PlayerId, standing.Points, standing.Wins, standing.Losses)
+	}
+
+	return nil
+}
+
+// grant gives a user a role, keeping the player it is. Admins give roles
+// through the API, the first one needs this.
+func grant(ctx context.Context, dbConn *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("grant", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	role := flags.String("role", models.RoleAdmin, "admin, organiser, referee or player")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	switch *role {
+	case models.RoleAdmin, models.RoleOrganiser, models.RoleReferee, models.RolePlayer:
+	default:
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	user, err := models.SelectUserByEmail(ctx, dbConn, *email)
+	if err != nil {
+		return err
+	}
+	err = models.UpdateUserAccess(ctx, dbConn, user.Id, models.UserAccess{Role: *role, PlayerId: user.PlayerId}, "grant")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now %s\n", user.Email, *role)
+
+	return nil
+}
+
+// configCommand runs the config command, which needs no database and works
+// with an invalid config:
+//
+//	config print  print the config the API would run with, secrets redacted
+func configCommand(w io.Writer, conf Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: config print")
+	}
+	printConfig(w, conf)
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/handlers"
+	"example.com/m/v2/models"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is what the API runs with. It is read from the environment, then from
+// the config file, then from flags, each overriding the one before, on top of
+// the defaults.
+type Config struct {
+	DbName             string
+	AwsAccessKeyId     string // the default AWS credentials are used when empty
+	AwsSecretAccessKey string
+	AwsBucketName      string
+	AwsRegion          string
+	JwtSecret          string
+	PurgeRetention     time.Duration // how long soft deleted rows are kept
+	ScoringRule        string
+	GrpcPort           int
+	ListenAddr         string // of the REST API
+	TlsCertFile        string // served over HTTPS when set, with TlsKeyFile
+	TlsKeyFile         string
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	ShutdownTimeout    time.Duration // how long requests in flight may take to finish on shutdown
+	LogLevel           slog.Level
+	RateLimits         handlers.RateLimits
+	TrustedProxies     []string
+
+	sources map[string]string // where each setting came from, by key
+}
+
+// ConfigError lists everything wrong with the config, so it can all be fixed
+// at once.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "Invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// configSetting is a setting of Config, named key in the config file, -key
+// with dashes as a flag and env in the environment.
+type configSetting struct {
+	key    string
+	env    string
+	usage  string
+	secret bool // redacted when printed
+	set    func(conf *Config, value string) error
+	get    func(conf *Config) string
+}
+
+func stringSetting(key string, env string, usage string, field func(*Config) *string) configSetting {
+	return configSetting{key: key, env: env, usage: usage,
+		set: func(conf *Config, value string) error {
+			*field(conf) = value
+			return nil
+		},
+		get: func(conf *Config) string { return *field(conf) },
+	}
+}
+
+func secretSetting(setting configSetting) configSetting {
+	setting.secret = true
+	return setting
+}
+
+func durationSetting(key string, env string, usage string, field func(*Config) *time.Duration) configSetting {
+	return configSetting{key: key, env: env, usage: usage,
+		set: func(conf *Config, value string) error {
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				return fmt.Errorf("%q is not a positive duration, such as 720h", value)
+			}
+			*field(conf) = duration
+			return nil
+		},
+		get: func(conf *Config) string { return field(conf).String() },
+	}
+}
+
+func portSetting(key string, env string, usage string, field func(*Config) *int) configSetting {
+	return configSetting{key: key, env: env, usage: usage,
+		set: func(conf *Config, value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("%q is not a port", value)
+			}
+			*field(conf) = port
+			return nil
+		},
+		get: func(conf *Config) string { return strconv.Itoa(*field(conf)) },
+	}
+}
+
+func levelSetting(key string, env string, usage string, field func(*Config) *slog.Level) configSetting {
+	return configSetting{key: key, env: env, usage: usage,
+		set: func(conf *Config, value string) error {
+			err := field(conf).UnmarshalText([]byte(value))
+			if err != nil {
+				return fmt.Errorf("%q is not a log level, such as info", value)
+			}
+			return nil
+		},
+		get: func(conf *Config) string { return strings.ToLower(field(conf).String()) },
+	}
+}
+
+func rateLimitSetting(group string, usage string) configSetting {
+	return configSetting{key: "rate_limit_" + group, env: "RATE_LIMIT_" + strings.ToUpper(group), usage: usage + ", as requests/period",
+		set: func(conf *Config, value string) error {
+			limit, err := handlers.ParseLimit(value)
+			if err != nil {
+				return err
+			}
+			conf.RateLimits[group] = limit
+			return nil
+		},
+		get: func(conf *Config) string { return conf.RateLimits[group].String() },
+	}
+}
+
+// configSettings are all the settings, in the order they are printed.
+var configSettings = []configSetting{
+	stringSetting("db_name", "DB_NAME", "SQLite database file", func(c *Config) *string { return &c.DbName }),
+	stringSetting("aws_access_key_id", "AWS_ACCESS_KEY_ID", "AWS access key, the default credentials are used when empty", func(c *Config) *string { return &c.AwsAccessKeyId }),
+	secretSetting(stringSetting("aws_secret_access_key", "AWS_SECRET_ACCESS_KEY", "AWS secret key", func(c *Config) *string { return &c.AwsSecretAccessKey })),
+	stringSetting("aws_bucket_name", "AWS_BUCKET_NAME", "S3 bucket of the profile pictures", func(c *Config) *string { return &c.AwsBucketName }),
+	stringSetting("aws_region", "AWS_REGION", "AWS region of the bucket", func(c *Config) *string { return &c.AwsRegion }),
+	secretSetting(stringSetting("jwt_secret", "JWT_SECRET", "secret the access tokens are signed with, at least 32 characters", func(c *Config) *string { return &c.JwtSecret })),
+	durationSetting("purge_retention", "PURGE_RETENTION", "how long soft deleted players and matches are kept", func(c *Config) *time.Duration { return &c.PurgeRetention }),
+	stringSetting("scoring_rule", "SCORING_RULE", "how results turn into points, default or flat", func(c *Config) *string { return &c.ScoringRule }),
+	portSetting("grpc_port", "GRPC_PORT", "port of the gRPC API", func(c *Config) *int { return &c.GrpcPort }),
+	stringSetting("listen_addr", "LISTEN_ADDR", "address the REST API listens on", func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("tls_cert_file", "TLS_CERT_FILE", "TLS certificate, to serve the REST API over HTTPS", func(c *Config) *string { return &c.TlsCertFile }),
+	stringSetting("tls_key_file", "TLS_KEY_FILE", "TLS private key of the certificate", func(c *Config) *string { return &c.TlsKeyFile }),
+	durationSetting("read_timeout", "READ_TIMEOUT", "how long reading a request may take", func(c *Config) *time.Duration { return &c.ReadTimeout }),
+	durationSetting("write_timeout", "WRITE_TIMEOUT", "how long writing a response may take, but for live streams", func(c *Config) *time.Duration { return &c.WriteTimeout }),
+	durationSetting("idle_timeout", "IDLE_TIMEOUT", "how long idle keep-alive connections are kept", func(c *Config) *time.Duration { return &c.IdleTimeout }),
+	durationSetting("shutdown_timeout", "SHUTDOWN_TIMEOUT", "how long requests in flight may take to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	levelSetting("log_level", "LOG_LEVEL", "least severe level logged: debug, info, warn or error", func(c *Config) *slog.Level { return &c.LogLevel }),
+	rateLimitSetting(handlers.RateLimitAuth, "rate limit of the auth routes"),
+	rateLimitSetting(handlers.RateLimitRead, "rate limit of the read routes"),
+	rateLimitSetting(handlers.RateLimitWrite, "rate limit of the write routes"),
+	rateLimitSetting(handlers.RateLimitIp, "rate limit of every IP, before credentials are checked"),
+	{key: "trusted_proxies", env: "TRUSTED_PROXIES", usage: "comma separated IPs or CIDRs of the proxies that may tell the client IP",
+		set: func(conf *Config, value string) error {
+			conf.TrustedProxies = nil
+			for _, proxy := range strings.Split(value, ",") {
+				if proxy = strings.TrimSpace(proxy); proxy == "" {
+					continue
+				} else if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+					return fmt.Errorf("%q is not an IP or CIDR", proxy)
+				}
+				conf.TrustedProxies = append(conf.TrustedProxies, proxy)
+			}
+			return nil
+		},
+		get: func(conf *Config) string { return strings.Join(conf.TrustedProxies, ",") },
+	},
+}
+
+func defaultConfig() Config {
+	conf := Config{
+		DbName:          "pool.db",
+		PurgeRetention:  30 * 24 * time.Hour,
+		ScoringRule:     "default",
+		GrpcPort:        9090,
+		ListenAddr:      ":8080",
+		ReadTimeout:     15 * time.Second,
+		WriteTimeout:    60 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		RateLimits:      handlers.RateLimits{},
+		sources:         map[string]string{},
+	}
+	for group, limit := range handlers.DefaultRateLimits {
+		conf.RateLimits[group] = limit
+	}
+	return conf
+}
+
+// loadConfig reads the config from getenv, the config file and the flags in
+// args, and returns the arguments left after the flags. The config file is
+// given with -config or CONFIG_FILE, YAML or TOML by its extension. Whatever is
+// wrong is reported at once as a ConfigError, along with the config as far as
+// it could be read.
+func loadConfig(args []string, getenv func(string) string) (Config, []string, error) {
+	var problems ConfigError
+	conf := defaultConfig()
+	apply := func(setting configSetting, value string, source string) {
+		err := setting.set(&conf, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s from %s: %s", setting.key, source, err))
+			return
+		}
+		conf.sources[setting.key] = source
+	}
+
+	flags := flag.NewFlagSet("pool", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("CONFIG_FILE"), "YAML or TOML config file")
+	flagValues := map[string]*string{}
+	for _, setting := range configSettings {
+		flagValues[setting.key] = flags.String(strings.ReplaceAll(setting.key, "_", "-"), "", setting.usage+", or "+setting.env)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	for _, setting := range configSettings {
+		if value := getenv(setting.env); value != "" {
+			apply(setting, value, "env "+setting.env)
+		}
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, setting := range configSettings {
+			if value, ok := values[setting.key]; ok {
+				apply(setting, value, "file "+*configFile)
+				delete(values, setting.key)
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(values)) {
+			problems = append(problems, fmt.Sprintf("%s from file %s: unknown setting", key, *configFile))
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if f.Name == strings.ReplaceAll(setting.key, "_", "-") {
+				apply(setting, *flagValues[setting.key], "flag -"+f.Name)
+			}
+		}
+	})
+
+	problems = append(problems, conf.validate()...)
+	if len(problems) > 0 {
+		return conf, flags.Args(), problems
+	}
+	return conf, flags.Args(), nil
+}
+
+// readConfigFile reads the settings of a YAML or TOML file as strings, as if
+// they came from the environment. Lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	var raw map[string]any
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	case ".toml":
+		err = toml.Unmarshal(content, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	for key, value := range raw {
+		if list, ok := value.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		} else {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// describeSetting names the setting with key in all the ways it can be set.
+func describeSetting(key string) string {
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return fmt.Sprintf("%s (%s or -%s)", key, setting.env, strings.ReplaceAll(key, "_", "-"))
+		}
+	}
+	return key
+}
+
+// validate returns what is wrong with conf beyond values that don't parse.
+func (conf Config) validate() []string {
+	var problems []string
+
+	for _, required := range []struct{ key, value string }{{"db_name", conf.DbName}, {"aws_bucket_name", conf.AwsBucketName}, {"aws_region", conf.AwsRegion}} {
+		if required.value == "" {
+			problems = append(problems, describeSetting(required.key)+": required")
+		}
+	}
+	if len(conf.JwtSecret) < 32 {
+		problems = append(problems, describeSetting("jwt_secret")+": must be at least 32 characters")
+	}
+	if (conf.AwsAccessKeyId == "") != (conf.AwsSecretAccessKey == "") {
+		problems = append(problems, "aws_access_key_id and aws_secret_access_key: set both or neither")
+	}
+	if conf.ListenAddr == "" {
+		problems = append(problems, describeSetting("listen_addr")+": required")
+	} else if _, _, err := net.SplitHostPort(conf.ListenAddr); err != nil {
+		problems = append(problems, describeSetting("listen_addr")+": must be host:port")
+	}
+	if (conf.TlsCertFile == "") != (conf.TlsKeyFile == "") {
+		problems = append(problems, "tls_cert_file and tls_key_file: set both or neither")
+	}
+	_, err := models.ScoringRuleByName(conf.ScoringRule)
+	if err != nil {
+		problems = append(problems, describeSetting("scoring_rule")+": "+err.Error())
+	}
+	return problems
+}
+
+// printConfig writes conf as a config file would hold it, with where each
+// setting came from and the secrets redacted.
+func printConfig(w io.Writer, conf Config) {
+	for _, setting := range configSettings {
+		value := setting.get(&conf)
+		if setting.secret && value != "" {
+			value = "<redacted>"
+		}
+		source, ok := conf.sources[setting.key]
+		if !ok {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%s: %s # %s\n", setting.key, strconv.Quote(value), source)
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+func errForbidden(detail string) models.Problem {
+	return models.NewProblem(http.StatusForbidden, "auth.forbidden", detail)
+}
+
+// principal is who a request is made by, a user signed in with an access
+// token or a service with an API key. Neither for anonymous requests.
+type principal struct {
+	user   *models.User
+	apiKey *models.ApiKey
+}
+
+// can tells whether p may do what permission allows. Users have the
+// permissions of their role, API keys those of their scopes.
+func (p principal) can(permission string) bool {
+	if p.user != nil {
+		return models.HasPermission(p.user.Role, permission)
+	} else if p.apiKey != nil {
+		return p.apiKey.HasScope(permission)
+	}
+	return false
+}
+
+// name identifies p in the audit log, by the email of the user or the prefix
+// of the API key.
+func (p principal) name() string {
+	if p.user != nil {
+		return p.user.Email
+	} else if p.apiKey != nil {
+		return "apikey:" + p.apiKey.Prefix
+	}
+	return "anonymous"
+}
+
+// id identifies p among the users and the API keys, empty when anonymous.
+func (p principal) id() string {
+	if p.user != nil {
+		return fmt.Sprintf("user:%d", p.user.Id)
+	} else if p.apiKey != nil {
+		return fmt.Sprintf("apikey:%d", p.apiKey.Id)
+	}
+	return ""
+}
+
+// hasAnyPermission tells whether p may do what one of permissions allows.
+func hasAnyPermission(p principal, permissions []string) bool {
+	for _, permission := range permissions {
+		if p.can(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Require lets the request through only if the user or API key it was
+// authenticated with has one of permissions. Handlers check what it may do
+// with the object itself.
+func (h Handler) Require(permissions ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !hasAnyPermission(currentPrincipal(ctx), permissions) {
+			respondProblem(ctx, errForbidden("You need one of these permissions: "+strings.Join(permissions, ", ")))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// ownsPlayer tells whether p is a user linked to player, through an approved
+// claim or by an admin.
+func ownsPlayer(p principal, player models.Player) bool {
+	return p.user != nil && p.user.PlayerId != nil && *p.user.PlayerId == player.Id
+}
+
+// playerChangeAllowed checks p may change the player from before to after.
+// Players may only change the preferred cue of the player they are.
+func playerChangeAllowed(p principal, before models.Player, after models.Player) error {
+	if p.can(models.PermissionPlayersUpdate) {
+		return nil
+	} else if !p.can(models.PermissionProfileUpdate) || !ownsPlayer(p, before) {
+		return errForbidden("You can only change your own profile")
+	}
+	if after.Name != before.Name || after.ProfilePictureUrl != before.ProfilePictureUrl {
+		return errForbidden("You can only change your preferred cue")
+	}
+	return nil
+}
+
+// deletedAllowed checks p may list the soft deleted records it asks for.
+func deletedAllowed(p principal, includeDeleted bool) error {
+	if includeDeleted && !p.can(models.PermissionDeletedRead) {
+		return errForbidden("Only admins can list deleted records")
+	}
+	return nil
+}
+
+// matchChangeAllowed checks p may change the match from before to after.
+// Rescheduling and recording the result are allowed separately.
+func matchChangeAllowed(p principal, before models.Match, after models.Match) error {
+	rescheduled := after.Player1id != before.Player1id || after.Player2id != before.Player2id || !after.StartTime.Equal(before.StartTime) || after.TableNumber != before.TableNumber
+	resulted := after.WinnerId != before.WinnerId || !after.EndTime.Equal(before.EndTime)
+	if rescheduled && !p.can(models.PermissionMatchesUpdate) {
+		return errForbidden("You can't reschedule matches")
+	} else if resulted && !p.can(models.PermissionResultsWrite) {
+		return errForbidden("You can't record results")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+var errApiKeyNotFound = models.NewProblem(http.StatusNotFound, "api_key.not_found", "API key not found")
+
+// @Summary Post API key
+// @Description Create an API key for a service, sent as the X-API-Key header. Its scopes are the permissions it has, players:read and matches:read only limit what it reads as reading is open. The key is only shown in this response.
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Param apiKey body models.ApiKey true "Name, scopes and requests a minute"
+// @Success 200 {object} models.ApiKey
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /api-keys [post]
+func (h Handler) PostApiKey(ctx *gin.Context) {
+	var err error
+	var apiKey models.ApiKey
+
+	err = ctx.ShouldBindJSON(&apiKey)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	apiKey.CreatedBy = actor(ctx)
+	_, err = apiKey.Create(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, apiKey)
+}
+
+// @Summary Get API keys
+// @Description Get all API keys, without the keys themselves, with when they were last used
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Success 200 {array} models.ApiKey
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /api-keys [get]
+func (h Handler) GetApiKeys(ctx *gin.Context) {
+	apiKeys, err := models.SelectApiKeys(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, apiKeys)
+}
+
+// @Summary Rotate API key
+// @Description Replace an API key by a new one with the same scopes and rate limit. The old key stops working at once, the new one is only shown in this response.
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Param id path string true "API key ID"
+// @Success 200 {object} models.ApiKey
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /api-keys/{id}/rotate [post]
+func (h Handler) RotateApiKey(ctx *gin.Context) {
+	var err error
+	var id int
+	var apiKey models.ApiKey
+
+	id, err = strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, errApiKeyNotFound)
+		return
+	}
+	apiKey, err = models.RotateApiKey(ctx, h.DbConn, id, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, apiKey)
+}
+
+// @Summary Revoke API key
+// @Description Revoke an API key, it stops working at once
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Param id path string true "API key ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /api-keys/{id} [delete]
+func (h Handler) RevokeApiKey(ctx *gin.Context) {
+	var err error
+	var id int
+
+	id, err = strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, errApiKeyNotFound)
+		return
+	}
+	err = models.RevokeApiKey(ctx, h.DbConn, id, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
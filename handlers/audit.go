@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Get audit events
+// @Description Get the audit log, optionally for a single entity. Organisers and admins only.
+// @Tags audit
+// @Accept json
+// @Produce json
+// @Param entity query string false "Entity type (player, match, user, claim or apikey)"
+// @Param id query string false "Entity ID"
+// @Success 200 {array} models.AuditEvent
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /audit [get]
+func (h Handler) GetAuditEvents(ctx *gin.Context) {
+	var err error
+	var events []models.AuditEvent
+	var query = struct {
+		Entity string `form:"entity" binding:"omitempty,oneof=player match user claim apikey"`
+		Id     string `form:"id"`
+	}{}
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	events, err = models.SelectAuditEvents(ctx, h.DbConn, query.Entity, query.Id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, events)
+}
+
+// actor identifies who made the request, by the email of the user or the
+// prefix of the API key it was authenticated with.
+func actor(ctx *gin.Context) string {
+	return currentPrincipal(ctx).name()
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// AccessTokenTTL is short, as access tokens can't be revoked.
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is how long a user stays signed in without using the API.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	accessToken  = "access"
+	refreshToken = "refresh"
+
+	principalKey = "principal"
+
+	// apiKeyHeader carries the API key of a service, instead of an access token.
+	apiKeyHeader = "X-API-Key"
+)
+
+var errAuthRequired = models.NewProblem(http.StatusUnauthorized, "auth.required", "Sign in and send the access token as a Bearer token, or send an API key as X-API-Key")
+
+var errInvalidToken = models.NewProblem(http.StatusUnauthorized, "auth.invalid_token", "Token is invalid or expired")
+
+// tokenClaims are the claims of the tokens we issue, the subject is the id of
+// the user.
+type tokenClaims struct {
+	Email string `json:"email"`
+	Type  string `json:"typ"` // access or refresh, so one can't stand for the other
+	jwt.RegisteredClaims
+}
+
+// Tokens are given to a user that signs in. The access token authenticates
+// requests, the refresh token gets a new pair once it expires.
+type Tokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"` // seconds the access token is valid for
+}
+
+func newToken(secret []byte, user models.User, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		Email: user.Email,
+		Type:  tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.Id),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+// NewAccessToken signs an access token for user with secret, as signing in
+// would. Tests use it to authenticate without going through /auth/login.
+func NewAccessToken(secret []byte, user models.User) (string, error) {
+	return newToken(secret, user, accessToken, AccessTokenTTL)
+}
+
+func (h Handler) issueTokens(user models.User) (Tokens, error) {
+	access, err := NewAccessToken(h.JwtSecret, user)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refresh, err := newToken(h.JwtSecret, user, refreshToken, RefreshTokenTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{AccessToken: access, RefreshToken: refresh, TokenType: "Bearer", ExpiresIn: int(AccessTokenTTL.Seconds())}, nil
+}
+
+// parseToken returns the user a token of tokenType was issued to.
+func (h Handler) parseToken(raw string, tokenType string) (models.User, error) {
+	var claims tokenClaims
+
+	_, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) {
+		return h.JwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithExpirationRequired())
+	if err != nil || claims.Type != tokenType {
+		return models.User{}, errInvalidToken
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return models.User{}, errInvalidToken
+	}
+	return models.User{Id: id, Email: claims.Email}, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// Authenticate lets the request through only with a valid access token or API
+// key, and keeps the user or key for the handlers.
+func (h Handler) Authenticate(ctx *gin.Context) {
+	apiKey := ctx.GetHeader(apiKeyHeader)
+	authorization := ctx.GetHeader("Authorization")
+	if apiKey == "" && authorization == "" {
+		ctx.Header("WWW-Authenticate", `Bearer realm="pool"`)
+		respondProblem(ctx, errAuthRequired)
+		return
+	}
+	h.identify(ctx, apiKey, authorization)
+}
+
+// Identify authenticates the requests that carry credentials like
+// Authenticate does, and lets the others through anonymously. Users and API
+// keys must have one of permissions, which only limits what keys read.
+func (h Handler) Identify(permissions ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		apiKey := ctx.GetHeader(apiKeyHeader)
+		authorization := ctx.GetHeader("Authorization")
+		if apiKey == "" && authorization == "" {
+			ctx.Next()
+			return
+		}
+		h.identify(ctx, apiKey, authorization)
+		if !ctx.IsAborted() && !hasAnyPermission(currentPrincipal(ctx), permissions) {
+			respondProblem(ctx, errForbidden("You need one of these permissions: "+strings.Join(permissions, ", ")))
+		}
+	}
+}
+
+// identify authenticates the credentials of the request, or aborts it.
+func (h Handler) identify(ctx *gin.Context, apiKey string, authorization string) {
+	p, err := h.authenticate(ctx, apiKey, authorization)
+	if err != nil {
+		ctx.Header("WWW-Authenticate", `Bearer realm="pool", error="invalid_token"`)
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.Set(principalKey, p)
+}
+
+// authenticate returns who the credentials belong to, the API key when one is
+// given or else the user of the Bearer access token. The last use of API keys
+// is recorded.
+func (h Handler) authenticate(ctx context.Context, apiKey string, authorization string) (principal, error) {
+	if apiKey != "" {
+		key, err := models.AuthenticateApiKey(ctx, h.DbConn, apiKey)
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{apiKey: &key}, models.TouchApiKey(ctx, h.DbConn, key.Id, time.Now())
+	}
+	token, ok := bearerToken(authorization)
+	if !ok {
+		return principal{}, errInvalidToken
+	}
+	user, err := h.authenticateToken(ctx, token)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{user: &user}, nil
+}
+
+// authenticateToken returns the user an access token was issued to, as it is
+// now, so a new role applies to the tokens issued before.
+func (h Handler) authenticateToken(ctx context.Context, token string) (models.User, error) {
+	user, err := h.parseToken(token, accessToken)
+	if err != nil {
+		return models.User{}, err
+	}
+	return h.currentAccount(ctx, user.Id)
+}
+
+// currentAccount loads the user with id, which may have been deleted since its
+// token was issued.
+func (h Handler) currentAccount(ctx context.Context, id int) (models.User, error) {
+	var problem models.Problem
+
+	user, err := models.SelectUserById(ctx, h.DbConn, id)
+	if errors.As(err, &problem) && problem.Status == http.StatusNotFound {
+		return models.User{}, errInvalidToken
+	}
+	return user, err
+}
+
+// currentPrincipal returns who the request was authenticated as, nobody for
+// anonymous requests.
+func currentPrincipal(ctx *gin.Context) principal {
+	p, _ := ctx.Value(principalKey).(principal)
+	return p
+}
+
+// currentUser returns the user the request was authenticated as, unless it
+// was made with an API key or anonymously.
+func currentUser(ctx *gin.Context) (models.User, bool) {
+	p := currentPrincipal(ctx)
+	if p.user == nil {
+		return models.User{}, false
+	}
+	return *p.user, true
+}
+
+// @Summary Register
+// @Description Create a user account and sign it in
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body models.Credentials true "Email and password, at least 8 characters"
+// @Success 200 {object} Tokens
+// @Failure 400 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /auth/register [post]
+func (h Handler) PostRegister(ctx *gin.Context) {
+	var err error
+	var credentials models.Credentials
+	var user models.User
+	var tokens Tokens
+
+	err = ctx.ShouldBindJSON(&credentials)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	user, err = models.NewUser(credentials)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	_, err = user.Create(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	tokens, err = h.issueTokens(user)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// @Summary Login
+// @Description Sign in with email and password
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body models.Credentials true "Email and password"
+// @Success 200 {object} Tokens
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /auth/login [post]
+func (h Handler) PostLogin(ctx *gin.Context) {
+	var err error
+	var credentials models.Credentials
+	var user models.User
+	var tokens Tokens
+
+	err = ctx.ShouldBindJSON(&credentials)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	user, err = models.AuthenticateUser(ctx, h.DbConn, credentials)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	tokens, err = h.issueTokens(user)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// @Summary Refresh
+// @Description Trade a refresh token for a new pair of tokens
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param refresh body object true "Refresh token, as refreshToken"
+// @Success 200 {object} Tokens
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /auth/refresh [post]
+func (h Handler) PostRefresh(ctx *gin.Context) {
+	var err error
+	var user models.User
+	var tokens Tokens
+	var body struct {
+		RefreshToken string `json:"refreshToken" binding:"required"`
+	}
+
+	err = ctx.ShouldBindJSON(&body)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	user, err = h.parseToken(body.RefreshToken, refreshToken)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	user, err = h.currentAccount(ctx, user.Id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	tokens, err = h.issueTokens(user)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Claim player
+// @Description Ask to be linked to a player, an organiser approves or rejects the claim. Once approved, the user owns the profile of the player.
+// @Tags claims
+// @Accept json
+// @Produce json
+// @Param id path string true "Player ID"
+// @Success 200 {object} models.PlayerClaim
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /players/{id}/claim [post]
+func (h Handler) PostPlayerClaim(ctx *gin.Context) {
+	var err error
+	var playerId int
+	var claim models.PlayerClaim
+	var user, ok = currentUser(ctx)
+
+	if !ok {
+		respondProblem(ctx, errForbidden("Only users can claim players"))
+		return
+	}
+	playerId, err = strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "player.not_found", fmt.Sprintf("Player with id %s not found", ctx.Param("id"))))
+		return
+	}
+	claim, err = models.CreatePlayerClaim(ctx, h.DbConn, user.Id, playerId, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, claim)
+}
+
+// @Summary Get player claims
+// @Description Get the claims of users on players
+// @Tags claims
+// @Accept json
+// @Produce json
+// @Param status query string false "pending, approved or rejected"
+// @Success 200 {array} models.PlayerClaim
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /claims [get]
+func (h Handler) GetPlayerClaims(ctx *gin.Context) {
+	var err error
+	var claims []models.PlayerClaim
+	var query = struct {
+		Status string `form:"status" binding:"omitempty,oneof=pending approved rejected"`
+	}{}
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	claims, err = models.SelectPlayerClaims(ctx, h.DbConn, query.Status)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, claims)
+}
+
+// @Summary Approve player claim
+// @Description Link the user to the player it claimed, the other claims on the player are rejected
+// @Tags claims
+// @Accept json
+// @Produce json
+// @Param id path string true "Claim ID"
+// @Success 200 {object} models.PlayerClaim
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /claims/{id}/approve [post]
+func (h Handler) ApprovePlayerClaim(ctx *gin.Context) {
+	h.decidePlayerClaim(ctx, true)
+}
+
+// @Summary Reject player claim
+// @Description Turn down a claim on a player
+// @Tags claims
+// @Accept json
+// @Produce json
+// @Param id path string true "Claim ID"
+// @Success 200 {object} models.PlayerClaim
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /claims/{id}/reject [post]
+func (h Handler) RejectPlayerClaim(ctx *gin.Context) {
+	h.decidePlayerClaim(ctx, false)
+}
+
+func (h Handler) decidePlayerClaim(ctx *gin.Context, approve bool) {
+	var err error
+	var id int
+	var claim models.PlayerClaim
+
+	id, err = strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "claim.not_found", fmt.Sprintf("Pending claim with id %s not found", ctx.Param("id"))))
+		return
+	}
+	claim, err = models.DecidePlayerClaim(ctx, h.DbConn, id, approve, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, claim)
+}
+
+// @Summary Post profile picture URL
+// @Description Get a URL to upload the profile picture of your own player to
+// @Tags players
+// @Accept json
+// @Produce json
+// @Param id path string true "Player ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /players/{id}/picture [post]
+func (h Handler) PostProfilePictureUrl(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var player models.Player
+	var presignedUrl string
+	var caller = currentPrincipal(ctx)
+
+	player, err = models.SelectPlayerById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if !ownsPlayer(caller, player) {
+		respondProblem(ctx, errForbidden("You can only upload the picture of your own player"))
+		return
+	}
+	presignedUrl, err = h.createPresignedUrl(ctx, fmt.Sprintf("%d_%s", player.Id, player.Name))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Upload your profile picture to the following URL", "url": presignedUrl})
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+func etag(version int) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// etagListed tells whether an If-Match or If-None-Match header value lists
+// the ETag of version. Weak ETags compare like strong ones, as the version
+// identifies the whole representation.
+func etagListed(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch answers 412 and returns false when the request has an If-Match
+// header that doesn't name version, so the client is editing a stale copy.
+func checkIfMatch(ctx *gin.Context, version int) bool {
+	header := ctx.GetHeader("If-Match")
+	if header != "" && !etagListed(header, version) {
+		respondProblem(ctx, models.NewProblem(http.StatusPreconditionFailed, "request.precondition_failed", "If-Match does not match the current version"))
+		return false
+	}
+	return true
+}
+
+// notModified sets the ETag of version and answers 304 when the request's
+// If-None-Match header names it.
+func notModified(ctx *gin.Context, version int) bool {
+	ctx.Header("ETag", etag(version))
+	header := ctx.GetHeader("If-None-Match")
+	if header != "" && etagListed(header, version) {
+		ctx.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
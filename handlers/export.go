@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// exportQuery holds the parameters shared by the export endpoints.
+type exportQuery struct {
+	Format string `form:"format" binding:"omitempty,oneof=csv xlsx ndjson"`
+}
+
+// exportWriter writes an export one row at a time. NDJSON exports write value
+// as is, tabular ones write cells under a header row of the field names.
+type exportWriter interface {
+	WriteRow(value any, cells []any) error
+	Close() error
+}
+
+type csvExport struct {
+	writer *csv.Writer
+}
+
+func (e csvExport) WriteRow(value any, cells []any) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		record[i] = quoteFormula(formatCell(cell))
+	}
+	return e.writer.Write(record)
+}
+
+func (e csvExport) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type xlsxExport struct {
+	writer *xlsxWriter
+}
+
+func (e xlsxExport) WriteRow(value any, cells []any) error {
+	return e.writer.Write(cells)
+}
+
+func (e xlsxExport) Close() error {
+	return e.writer.Close()
+}
+
+type ndjsonExport struct {
+	encoder *json.Encoder
+}
+
+func (e ndjsonExport) WriteRow(value any, cells []any) error {
+	return e.encoder.Encode(value)
+}
+
+func (e ndjsonExport) Close() error {
+	return nil
+}
+
+// newExportWriter starts an export of format to w, CSV unless told otherwise.
+func newExportWriter(w io.Writer, format string, name string, fields []string) (exportWriter, error) {
+	var header = make([]any, len(fields))
+	for i, field := range fields {
+		header[i] = field
+	}
+
+	switch format {
+	case "ndjson":
+		return ndjsonExport{encoder: json.NewEncoder(w)}, nil
+	case "xlsx":
+		writer, err := newXlsxWriter(w, name)
+		if err != nil {
+			return nil, err
+		}
+		return xlsxExport{writer: writer}, writer.Write(header)
+	default:
+		export := csvExport{writer: csv.NewWriter(w)}
+		return export, export.WriteRow(nil, header)
+	}
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case "ndjson":
+		return ndjsonType
+	case "xlsx":
+		return xlsxType
+	default:
+		return csvType
+	}
+}
+
+// streamExport sends the rows that each writes as an attachment named after
+// the export, as they are read. Errors before the first row are answered as
+// problems, once the export is under way they can only cut it short.
+func streamExport(ctx *gin.Context, format string, name string, fields []string, each func(write func(value any, cells []any) error) error) {
+	var export exportWriter
+	var response = http.NewResponseController(ctx.Writer)
+
+	start := func() error {
+		var err error
+
+		if format == "" {
+			format = "csv"
+		}
+		ctx.Header("Content-Type", exportContentType(format))
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+		export, err = newExportWriter(ctx.Writer, format, name, fields)
+		return err
+	}
+	err := each(func(value any, cells []any) error {
+		// Exports may take longer than the write timeout of the server, as
+		// long as the client keeps up
+		response.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if export == nil {
+			err := start()
+			if err != nil {
+				return err
+			}
+		}
+		return export.WriteRow(value, cells)
+	})
+	if err == nil && export == nil {
+		err = start()
+	}
+	if err == nil {
+		err = export.Close()
+	}
+	if err != nil && !ctx.Writer.Written() {
+		ctx.Writer.Header().Del("Content-Disposition")
+		respondProblem(ctx, err)
+	} else if err != nil {
+		slog.WarnContext(ctx, "Export cut short", "export", name, "error", err)
+		ctx.Abort()
+	}
+}
+
+// quoteFormula quotes a cell of a CSV export with a leading ' when a
+// spreadsheet would take it for a formula, such as a player named
+// "=HYPERLINK(...)", so it stays text. XLSX cells don't need it, their text
+// cells are never read as formulas.
+func quoteFormula(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// formatCell writes a cell of a CSV export, or a text cell of an XLSX one.
+func formatCell(cell any) string {
+	switch value := cell.(type) {
+	case string:
+		return value
+	case int:
+		return strconv.Itoa(value)
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Format(time.RFC3339)
+	case *time.Time:
+		if value == nil {
+			return ""
+		}
+		return value.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+var playerExportFields = []string{"id", "name", "ranking", "preferredCue", "profilePictureUrl", "points", "deletedAt", "version"}
+
+// @Summary Export players
+// @Description Export the players as CSV, XLSX or NDJSON, with the same filters and sorting as the list
+// @Tags export
+// @Produce text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/x-ndjson
+// @Param format query string false "csv (default), xlsx or ndjson"
+// @Param name query string false "Player name"
+// @Param includeDeleted query bool false "Include soft deleted players, for admins only"
+// @Param sort query string false "Sort by id, name, ranking or points, prefixed with - for descending order"
+// @Success 200 {file} file
+// @Failure 400 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /export/players [get]
+func (h Handler) ExportPlayers(ctx *gin.Context) {
+	var err error
+	var query = struct {
+		Name           string `form:"name"`
+		IncludeDeleted bool   `form:"includeDeleted"`
+		Sort           string `form:"sort"`
+		exportQuery
+	}{}
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	err = deletedAllowed(currentPrincipal(ctx), query.IncludeDeleted)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	filter := models.PlayerFilter{Name: query.Name, IncludeDeleted: query.IncludeDeleted}
+	streamExport(ctx, query.Format, "players", playerExportFields, func(write func(value any, cells []any) error) error {
+		return models.EachPlayer(ctx, h.DbConn, filter, query.Sort, func(p models.Player) error {
+			return write(p, []any{p.Id, p.Name, p.Ranking, p.PreferredCue, p.ProfilePictureUrl, p.Points, p.DeletedAt, p.Version})
+		})
+	})
+}
+
+var matchExportFields = []string{"id", "player1id", "player1Name", "player2id", "player2Name", "startTime", "endTime", "winnerId", "winnerName", "tableNumber", "deletedAt", "version"}
+
+// @Summary Export matches
+// @Description Export the matches with the names of their players as CSV, XLSX or NDJSON, with the same filters and sorting as the list
+// @Tags export
+// @Produce text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/x-ndjson
+// @Param format query string false "csv (default), xlsx or ndjson"
+// @Param status query string false "Match status"
+// @Param includeDeleted query bool false "Include soft deleted matches, for admins only"
+// @Param playerId query int false "Matches played by this player"
+// @Param tableNumber query int false "Matches played on this table"
+// @Param winnerId query int false "Matches won by this player"
+// @Param from query string false "Matches starting at or after this time (RFC 3339)"
+// @Param to query string false "Matches starting at or before this time (RFC 3339)"
+// @Param sort query string false "Sort by id, startTime or tableNumber, prefixed with - for descending order"
+// @Success 200 {file} file
+// @Failure 400 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /export/matches [get]
+func (h Handler) ExportMatches(ctx *gin.Context) {
+	var err error
+	var query = struct {
+		Status         string    `form:"status"`
+		IncludeDeleted bool      `form:"includeDeleted"`
+		PlayerId       int       `form:"playerId"`
+		TableNumber    *int      `form:"tableNumber"`
+		WinnerId       int       `form:"winnerId"`
+		From           time.Time `form:"from"`
+		To             time.Time `form:"to"`
+		Sort           string    `form:"sort"`
+		exportQuery
+	}{}
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	err = deletedAllowed(currentPrincipal(ctx), query.IncludeDeleted)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	filter := models.MatchFilter{
+		Status:         query.Status,
+		PlayerId:       query.PlayerId,
+		TableNumber:    query.TableNumber,
+		WinnerId:       query.WinnerId,
+		From:           query.From,
+		To:             query.To,
+		IncludeDeleted: query.IncludeDeleted,
+	}
+	streamExport(ctx, query.Format, "matches", matchExportFields, func(write func(value any, cells []any) error) error {
+		return models.EachMatch(ctx, h.DbConn, filter, query.Sort, func(m models.ExportedMatch) error {
+			return write(m, []any{m.Id, m.Player1id, m.Player1Name, m.Player2id, m.Player2Name, m.StartTime, m.EndTime, m.WinnerId, m.WinnerName, m.TableNumber, m.DeletedAt, m.Version})
+		})
+	})
+}
+
+var standingExportFields = []string{"ranking", "playerId", "playerName", "points", "played", "wins", "losses"}
+
+// @Summary Export standings
+// @Description Export the standings with the names of the players as CSV, XLSX or NDJSON
+// @Tags export
+// @Produce text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/x-ndjson
+// @Param format query string false "csv (default), xlsx or ndjson"
+// @Success 200 {file} file
+// @Failure 400 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /export/standings [get]
+func (h Handler) ExportStandings(ctx *gin.Context) {
+	var err error
+	var query exportQuery
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	streamExport(ctx, query.Format, "standings", standingExportFields, func(write func(value any, cells []any) error) error {
+		standings, err := models.ExportStandings(ctx, h.DbConn, h.Scoring)
+		if err != nil {
+			return err
+		}
+		for _, s := range standings {
+			err = write(s, []any{s.Ranking, s.PlayerId, s.PlayerName, s.Points, s.Played, s.Wins, s.Losses})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
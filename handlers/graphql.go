@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+var statsType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "Stats",
+	Description: "Standing of a player, rebuilt from the match history",
+	Fields: graphql.Fields{
+		"ranking": &graphql.Field{Type: graphql.Int},
+		"points":  &graphql.Field{Type: graphql.Int},
+		"played":  &graphql.Field{Type: graphql.Int},
+		"wins":    &graphql.Field{Type: graphql.Int},
+		"losses":  &graphql.Field{Type: graphql.Int},
+	},
+})
+
+var playerType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Player",
+	Fields: graphql.Fields{
+		"id":                &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"name":              &graphql.Field{Type: graphql.String},
+		"ranking":           &graphql.Field{Type: graphql.Int},
+		"preferredCue":      &graphql.Field{Type: graphql.String},
+		"profilePictureUrl": &graphql.Field{Type: graphql.String},
+		"points":            &graphql.Field{Type: graphql.Int},
+		"deletedAt":         &graphql.Field{Type: graphql.DateTime},
+		"version":           &graphql.Field{Type: graphql.Int},
+		"stats": &graphql.Field{
+			Type: statsType,
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				return loadersFrom(p.Context).standing(p.Source.(models.Player).Id)
+			},
+		},
+	},
+})
+
+// playerField resolves a player id of a match into the player.
+func playerField(id func(models.Match) int) *graphql.Field {
+	return &graphql.Field{
+		Type: playerType,
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return loadersFrom(p.Context).player(id(p.Source.(models.Match))), nil
+		},
+	}
+}
+
+var matchType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Match",
+	Fields: graphql.Fields{
+		"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"player1":     playerField(func(m models.Match) int { return m.Player1id }),
+		"player2":     playerField(func(m models.Match) int { return m.Player2id }),
+		"winner":      playerField(func(m models.Match) int { return m.WinnerId }),
+		"startTime":   &graphql.Field{Type: graphql.DateTime},
+		"endTime":     &graphql.Field{Type: graphql.DateTime},
+		"tableNumber": &graphql.Field{Type: graphql.Int},
+		"deletedAt":   &graphql.Field{Type: graphql.DateTime},
+		"version":     &graphql.Field{Type: graphql.Int},
+	},
+})
+
+// pageArgs are the arguments of the list fields, as for the list endpoints.
+var pageArgs = graphql.FieldConfigArgument{
+	"sort":  &graphql.ArgumentConfig{Type: graphql.String},
+	"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+}
+
+func pageFromArgs(args map[string]any) models.Page {
+	sort, _ := args["sort"].(string)
+	limit, _ := args["limit"].(int)
+	return models.Page{Sort: sort, Limit: limit}
+}
+
+func withPageArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	for name, arg := range pageArgs {
+		args[name] = arg
+	}
+	return args
+}
+
+var queryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"players": &graphql.Field{
+			Type: graphql.NewList(graphql.NewNonNull(playerType)),
+			Args: withPageArgs(graphql.FieldConfigArgument{
+				"name":           &graphql.ArgumentConfig{Type: graphql.String},
+				"includeDeleted": &graphql.ArgumentConfig{Type: graphql.Boolean},
+			}),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				name, _ := p.Args["name"].(string)
+				includeDeleted, _ := p.Args["includeDeleted"].(bool)
+				err := deletedAllowed(loadersFrom(p.Context).caller, includeDeleted)
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				players, err := models.SelectPlayers(p.Context, loadersFrom(p.Context).h.DbConn, models.PlayerFilter{Name: name, IncludeDeleted: includeDeleted}, pageFromArgs(p.Args))
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				return players, nil
+			},
+		},
+		"player": &graphql.Field{
+			Type: playerType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				player, err := models.SelectPlayerById(p.Context, loadersFrom(p.Context).h.DbConn, fmt.Sprintf("%d", p.Args["id"].(int)))
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				return player, nil
+			},
+		},
+		"matches": &graphql.Field{
+			Type: graphql.NewList(graphql.NewNonNull(matchType)),
+			Args: withPageArgs(graphql.FieldConfigArgument{
+				"status":         &graphql.ArgumentConfig{Type: graphql.String},
+				"playerId":       &graphql.ArgumentConfig{Type: graphql.Int},
+				"tableNumber":    &graphql.ArgumentConfig{Type: graphql.Int},
+				"winnerId":       &graphql.ArgumentConfig{Type: graphql.Int},
+				"from":           &graphql.ArgumentConfig{Type: graphql.DateTime},
+				"to":             &graphql.ArgumentConfig{Type: graphql.DateTime},
+				"includeDeleted": &graphql.ArgumentConfig{Type: graphql.Boolean},
+			}),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				var filter models.MatchFilter
+
+				filter.Status, _ = p.Args["status"].(string)
+				filter.PlayerId, _ = p.Args["playerId"].(int)
+				filter.WinnerId, _ = p.Args["winnerId"].(int)
+				filter.IncludeDeleted, _ = p.Args["includeDeleted"].(bool)
+				err := deletedAllowed(loadersFrom(p.Context).caller, filter.IncludeDeleted)
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				if tableNumber, ok := p.Args["tableNumber"].(int); ok {
+					filter.TableNumber = &tableNumber
+				}
+				if from, ok := p.Args["from"].(*time.Time); ok {
+					filter.From = *from
+				}
+				if to, ok := p.Args["to"].(*time.Time); ok {
+					filter.To = *to
+				}
+				matches, err := models.SelectMatches(p.Context, loadersFrom(p.Context).h.DbConn, filter, pageFromArgs(p.Args))
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				return matches, nil
+			},
+		},
+		"match": &graphql.Field{
+			Type: matchType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				match, err := models.SelectMatchById(p.Context, loadersFrom(p.Context).h.DbConn, fmt.Sprintf("%d", p.Args["id"].(int)))
+				if err != nil {
+					return nil, graphqlError(p.Context, err)
+				}
+				return match, nil
+			},
+		},
+	},
+})
+
+var graphqlSchema graphql.Schema
+
+func init() {
+	var err error
+
+	// Players and matches refer to each other, so one of the links can only be
+	// added once both types exist
+	playerType.AddFieldConfig("matches", &graphql.Field{
+		Type:        graphql.NewList(graphql.NewNonNull(matchType)),
+		Description: "Matches played by the player, by start time",
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return loadersFrom(p.Context).matches(p.Source.(models.Player).Id), nil
+		},
+	})
+	graphqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// graphqlError hides internal errors from GraphQL clients like respondProblem
+// does for REST ones.
+func graphqlError(ctx context.Context, err error) error {
+	problem := toProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		slog.ErrorContext(ctx, "Internal error in GraphQL query", "error", err)
+	}
+	return problem
+}
+
+// @Summary GraphQL
+// @Description Query players and matches with GraphQL. Matches resolve to their players and players to their matches and stats, loaded in batches.
+// @Tags graphql
+// @Accept json
+// @Produce json
+// @Param query body object true "GraphQL request, with query, variables and operationName"
+// @Success 200 {object} object
+// @Failure 400 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Router /graphql [post]
+func (h Handler) PostGraphql(ctx *gin.Context) {
+	var err error
+	var request struct {
+		Query         string         `json:"query" binding:"required"`
+		Variables     map[string]any `json:"variables"`
+		OperationName string         `json:"operationName"`
+	}
+
+	err = ctx.ShouldBindJSON(&request)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        context.WithValue(ctx.Request.Context(), loadersKey{}, newLoaders(ctx.Request.Context(), h, currentPrincipal(ctx))),
+	})
+	ctx.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,530 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"example.com/m/v2/models"
+	"example.com/m/v2/poolpb"
+	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// problemCodes maps the HTTP status of a problem to the closest gRPC code.
+var problemCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusPreconditionFailed:    codes.Aborted,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnsupportedMediaType:  codes.InvalidArgument,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+}
+
+// NewGrpcServer serves the players and matches over gRPC, with the same rules
+// as the REST API. opts are added to its own options, such as the TLS
+// credentials.
+func NewGrpcServer(h Handler, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(logGrpc, recoverGrpc, h.authenticateGrpc), grpc.ChainStreamInterceptor(logGrpcStream, recoverGrpcStream, h.authenticateGrpcStream)}, opts...)
+	server := grpc.NewServer(opts...)
+	poolpb.RegisterPoolServiceServer(server, &poolServer{h: h})
+	return server
+}
+
+type poolServer struct {
+	poolpb.UnimplementedPoolServiceServer
+	h Handler
+}
+
+type grpcPrincipalKey struct{}
+
+// grpcPermissions are what the calls that change something require, one of
+// them like Require does for routes.
+var grpcPermissions = map[string][]string{
+	"CreatePlayer":  {models.PermissionPlayersCreate},
+	"UpdatePlayer":  {models.PermissionPlayersUpdate, models.PermissionProfileUpdate},
+	"DeletePlayer":  {models.PermissionPlayersDelete},
+	"RestorePlayer": {models.PermissionPlayersDelete},
+	"CreateMatch":   {models.PermissionMatchesCreate},
+	"UpdateMatch":   {models.PermissionMatchesUpdate, models.PermissionResultsWrite},
+	"DeleteMatch":   {models.PermissionMatchesDelete},
+	"RestoreMatch":  {models.PermissionMatchesDelete},
+}
+
+// grpcReadPermissions are what the calls that read require when made with
+// credentials, like Identify does for routes. Anonymous calls may read.
+var grpcReadPermissions = map[string][]string{
+	"ListPlayers": {models.PermissionPlayersRead},
+	"GetPlayer":   {models.PermissionPlayersRead},
+	"ListMatches": {models.PermissionMatchesRead},
+	"GetMatch":    {models.PermissionMatchesRead},
+	"WatchMatch":  {models.PermissionMatchesRead},
+}
+
+// firstValue returns the first value of key in md, if any.
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// peerIp returns the IP the call came from.
+func peerIp(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// authenticateGrpc requires a valid access token in the authorization
+// metadata, or an API key in the x-api-key metadata, for the calls that change
+// something, and a user or key allowed to make them. Calls that read are
+// authenticated only when they carry credentials. Calls are held to the rate
+// limits of the routes that do the same.
+func (h Handler) authenticateGrpc(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := h.authorizeGrpc(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// authenticateGrpcStream is authenticateGrpc for streaming calls.
+func (h Handler) authenticateGrpcStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := h.authorizeGrpc(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, contextStream{stream, ctx})
+}
+
+// authorizeGrpc checks the credentials and rate limit of a call to method,
+// and returns its context with who it was authenticated as. Methods that
+// aren't in grpcPermissions or grpcReadPermissions are refused, so a new call
+// is never left open by mistake.
+func (h Handler) authorizeGrpc(ctx context.Context, fullMethod string) (context.Context, error) {
+	var p principal
+	var err error
+
+	method := path.Base(fullMethod)
+	md, _ := metadata.FromIncomingContext(ctx)
+	apiKey := firstValue(md, strings.ToLower(apiKeyHeader))
+	authorization := firstValue(md, "authorization")
+	group := RateLimitWrite
+	permissions, ok := grpcPermissions[method]
+	if !ok {
+		group = RateLimitRead
+		permissions, ok = grpcReadPermissions[method]
+		if !ok {
+			return nil, grpcError(ctx, errForbidden("Call "+method+" is not allowed"))
+		}
+	} else if apiKey == "" && authorization == "" {
+		return nil, grpcError(ctx, errAuthRequired)
+	}
+	if result, ok := h.takeRequest(ctx, RateLimitIp, p, peerIp(ctx)); ok && !result.Allowed {
+		return nil, grpcError(ctx, errRateLimited)
+	}
+	if apiKey != "" || authorization != "" {
+		p, err = h.authenticate(ctx, apiKey, authorization)
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		} else if !hasAnyPermission(p, permissions) {
+			return nil, grpcError(ctx, errForbidden("You need one of these permissions: "+strings.Join(permissions, ", ")))
+		}
+	}
+	if result, ok := h.takeRequest(ctx, group, p, peerIp(ctx)); ok && !result.Allowed {
+		return nil, grpcError(ctx, errRateLimited)
+	}
+
+	return context.WithValue(ctx, grpcPrincipalKey{}, p), nil
+}
+
+// grpcError turns err into a gRPC status, keeping the problem code as the
+// reason and the invalid fields as violations. Internal errors are hidden like
+// respondProblem does.
+func grpcError(ctx context.Context, err error) error {
+	problem := toProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		slog.ErrorContext(ctx, "Internal error in gRPC call", "error", err)
+	}
+	code, ok := problemCodes[problem.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	st := status.New(code, problem.Detail)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: problem.Code, Domain: "pool"}}
+	if len(problem.Errors) > 0 {
+		violations := &errdetails.BadRequest{}
+		for _, fieldErr := range problem.Errors {
+			violations.FieldViolations = append(violations.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: fieldErr.Field, Description: fieldErr.Detail})
+		}
+		details = append(details, violations)
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// grpcPrincipal returns who the call was authenticated as, nobody for
+// anonymous calls.
+func grpcPrincipal(ctx context.Context) principal {
+	p, _ := ctx.Value(grpcPrincipalKey{}).(principal)
+	return p
+}
+
+// grpcActor identifies who made the call, like actor does for requests.
+func grpcActor(ctx context.Context) string {
+	return grpcPrincipal(ctx).name()
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func timeOf(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+func deletedAt(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func playerToProto(player models.Player) *poolpb.Player {
+	return &poolpb.Player{
+		Id:                int64(player.Id),
+		Name:              player.Name,
+		Ranking:           int32(player.Ranking),
+		PreferredCue:      player.PreferredCue,
+		ProfilePictureUrl: player.ProfilePictureUrl,
+		Points:            int32(player.Points),
+		DeletedAt:         deletedAt(player.DeletedAt),
+		Version:           int32(player.Version),
+	}
+}
+
+func matchToProto(match models.Match) *poolpb.Match {
+	return &poolpb.Match{
+		Id:          int64(match.Id),
+		Player1Id:   int64(match.Player1id),
+		Player2Id:   int64(match.Player2id),
+		StartTime:   timestamp(match.StartTime),
+		EndTime:     timestamp(match.EndTime),
+		WinnerId:    int64(match.WinnerId),
+		TableNumber: int32(match.TableNumber),
+		DeletedAt:   deletedAt(match.DeletedAt),
+		Version:     int32(match.Version),
+	}
+}
+
+func matchFromProto(match *poolpb.Match) models.Match {
+	return models.Match{
+		Id:          int(match.GetId()),
+		Player1id:   int(match.GetPlayer1Id()),
+		Player2id:   int(match.GetPlayer2Id()),
+		StartTime:   timeOf(match.GetStartTime()),
+		EndTime:     timeOf(match.GetEndTime()),
+		WinnerId:    int(match.GetWinnerId()),
+		TableNumber: int(match.GetTableNumber()),
+		Version:     int(match.GetVersion()),
+	}
+}
+
+func eventToProto(event models.MatchEvent) *poolpb.MatchEvent {
+	return &poolpb.MatchEvent{
+		Id:          int64(event.Id),
+		MatchId:     int64(event.MatchId),
+		Type:        event.Type,
+		OccurredAt:  timestamp(event.OccurredAt),
+		Player1Id:   int64(event.Player1id),
+		Player2Id:   int64(event.Player2id),
+		StartTime:   timestamp(event.StartTime),
+		EndTime:     timestamp(event.EndTime),
+		TableNumber: int32(event.TableNumber),
+		WinnerId:    int64(event.WinnerId),
+	}
+}
+
+func (s *poolServer) CreatePlayer(ctx context.Context, req *poolpb.CreatePlayerRequest) (*poolpb.CreatePlayerResponse, error) {
+	player := models.Player{
+		Name:         req.GetPlayer().GetName(),
+		PreferredCue: req.GetPlayer().GetPreferredCue(),
+	}
+	err := binding.Validator.ValidateStruct(&player)
+	if err != nil {
+		return nil, grpcError(ctx, clientProblem(err))
+	}
+	player, err = models.CreatePlayer(ctx, s.h.DbConn, player, s.h.profilePictureUrl, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &poolpb.CreatePlayerResponse{Player: playerToProto(player)}, nil
+}
+
+func (s *poolServer) ListPlayers(ctx context.Context, req *poolpb.ListPlayersRequest) (*poolpb.ListPlayersResponse, error) {
+	err := deletedAllowed(grpcPrincipal(ctx), req.GetIncludeDeleted())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	page := models.Page{Sort: req.GetSort(), Limit: int(req.GetLimit()), Cursor: req.GetCursor()}
+	players, err := models.SelectPlayers(ctx, s.h.DbConn, models.PlayerFilter{Name: req.GetName(), IncludeDeleted: req.GetIncludeDeleted()}, page)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	res := &poolpb.ListPlayersResponse{}
+	for _, player := range players {
+		res.Players = append(res.Players, playerToProto(player))
+	}
+	if len(players) > 0 {
+		res.NextCursor = nextCursor(page, len(players), players[len(players)-1])
+	}
+
+	return res, nil
+}
+
+func (s *poolServer) GetPlayer(ctx context.Context, req *poolpb.GetPlayerRequest) (*poolpb.Player, error) {
+	player, err := models.SelectPlayerById(ctx, s.h.DbConn, fmt.Sprintf("%d", req.GetId()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return playerToProto(player), nil
+}
+
+func (s *poolServer) UpdatePlayer(ctx context.Context, req *poolpb.UpdatePlayerRequest) (*poolpb.Player, error) {
+	id := fmt.Sprintf("%d", req.GetPlayer().GetId())
+	before, err := models.SelectPlayerById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	player := before
+	player.Name = req.GetPlayer().GetName()
+	player.PreferredCue = req.GetPlayer().GetPreferredCue()
+	player.Version = int(req.GetPlayer().GetVersion())
+	err = binding.Validator.ValidateStruct(&player)
+	if err != nil {
+		return nil, grpcError(ctx, clientProblem(err))
+	}
+	err = playerChangeAllowed(grpcPrincipal(ctx), before, player)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	_, err = models.UpdatePlayerById(ctx, s.h.DbConn, id, player, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	player.Version = before.Version + 1
+
+	return playerToProto(player), nil
+}
+
+func (s *poolServer) DeletePlayer(ctx context.Context, req *poolpb.DeletePlayerRequest) (*emptypb.Empty, error) {
+	id := fmt.Sprintf("%d", req.GetId())
+	_, err := models.DeletePlayerById(ctx, s.h.DbConn, id, int(req.GetVersion()), grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *poolServer) RestorePlayer(ctx context.Context, req *poolpb.RestorePlayerRequest) (*poolpb.Player, error) {
+	id := fmt.Sprintf("%d", req.GetId())
+	res, err := models.RestorePlayerById(ctx, s.h.DbConn, id, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	} else if rowsAffected == 0 {
+		return nil, grpcError(ctx, models.NewProblem(http.StatusNotFound, "player.not_found", "Deleted player not found"))
+	}
+	player, err := models.SelectPlayerById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return playerToProto(player), nil
+}
+
+func (s *poolServer) CreateMatch(ctx context.Context, req *poolpb.CreateMatchRequest) (*poolpb.Match, error) {
+	match := matchFromProto(req.GetMatch())
+	match.Id = 0
+	err := binding.Validator.ValidateStruct(&match)
+	if err != nil {
+		return nil, grpcError(ctx, clientProblem(err))
+	}
+	res, err := match.Create(ctx, s.h.DbConn, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	match, err = models.SelectMatchById(ctx, s.h.DbConn, fmt.Sprintf("%d", id))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	s.h.Hub.Publish(match.Id)
+
+	return matchToProto(match), nil
+}
+
+func (s *poolServer) ListMatches(ctx context.Context, req *poolpb.ListMatchesRequest) (*poolpb.ListMatchesResponse, error) {
+	filter := models.MatchFilter{
+		Status:         req.GetStatus(),
+		PlayerId:       int(req.GetPlayerId()),
+		WinnerId:       int(req.GetWinnerId()),
+		From:           timeOf(req.GetFrom()),
+		To:             timeOf(req.GetTo()),
+		IncludeDeleted: req.GetIncludeDeleted(),
+	}
+	if req.TableNumber != nil {
+		tableNumber := int(req.GetTableNumber())
+		filter.TableNumber = &tableNumber
+	}
+	err := deletedAllowed(grpcPrincipal(ctx), req.GetIncludeDeleted())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	page := models.Page{Sort: req.GetSort(), Limit: int(req.GetLimit()), Cursor: req.GetCursor()}
+	matches, err := models.SelectMatches(ctx, s.h.DbConn, filter, page)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	res := &poolpb.ListMatchesResponse{}
+	for _, match := range matches {
+		res.Matches = append(res.Matches, matchToProto(match))
+	}
+	if len(matches) > 0 {
+		res.NextCursor = nextCursor(page, len(matches), matches[len(matches)-1])
+	}
+
+	return res, nil
+}
+
+func (s *poolServer) GetMatch(ctx context.Context, req *poolpb.GetMatchRequest) (*poolpb.Match, error) {
+	match, err := models.SelectMatchById(ctx, s.h.DbConn, fmt.Sprintf("%d", req.GetId()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return matchToProto(match), nil
+}
+
+func (s *poolServer) UpdateMatch(ctx context.Context, req *poolpb.UpdateMatchRequest) (*poolpb.Match, error) {
+	id := fmt.Sprintf("%d", req.GetMatch().GetId())
+	before, err := models.SelectMatchById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	match := matchFromProto(req.GetMatch())
+	err = binding.Validator.ValidateStruct(&match)
+	if err != nil {
+		return nil, grpcError(ctx, clientProblem(err))
+	}
+	err = matchChangeAllowed(grpcPrincipal(ctx), before, match)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	err = models.RecordMatchResult(ctx, s.h.DbConn, id, match, s.h.Scoring, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	match, err = models.SelectMatchById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	s.h.Hub.Publish(before.Id)
+
+	return matchToProto(match), nil
+}
+
+func (s *poolServer) DeleteMatch(ctx context.Context, req *poolpb.DeleteMatchRequest) (*emptypb.Empty, error) {
+	id := fmt.Sprintf("%d", req.GetId())
+	match, err := models.SelectMatchById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	_, err = models.DeleteMatchById(ctx, s.h.DbConn, id, int(req.GetVersion()), s.h.Scoring, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	s.h.Hub.Publish(match.Id)
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *poolServer) RestoreMatch(ctx context.Context, req *poolpb.RestoreMatchRequest) (*poolpb.Match, error) {
+	id := fmt.Sprintf("%d", req.GetId())
+	res, err := models.RestoreMatchById(ctx, s.h.DbConn, id, s.h.Scoring, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	} else if rowsAffected == 0 {
+		return nil, grpcError(ctx, models.NewProblem(http.StatusNotFound, "match.not_found", "Deleted match not found"))
+	}
+	match, err := models.SelectMatchById(ctx, s.h.DbConn, id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	s.h.Hub.Publish(match.Id)
+
+	return matchToProto(match), nil
+}
+
+// WatchMatch follows the match like GetMatchEvents does. gRPC keeps the
+// connection alive itself, so there is no heartbeat to send.
+func (s *poolServer) WatchMatch(req *poolpb.WatchMatchRequest, stream grpc.ServerStreamingServer[poolpb.MatchEvent]) error {
+	ctx := stream.Context()
+	match, err := models.SelectMatchById(ctx, s.h.DbConn, fmt.Sprintf("%d", req.GetId()))
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	err = s.h.followMatch(ctx, ctx.Done(), match.Id, int(req.GetAfterEventId()), func(event models.MatchEvent) error {
+		return stream.Send(eventToProto(event))
+	}, func() error {
+		return nil
+	})
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+
+	return nil
+}
@@ -3,17 +3,27 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
+	"example.com/m/v2/models"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type Handler struct {
-	DbConn     *sql.DB
-	S3Client   *s3.Client
-	BucketName string
-	Region     string
+	DbConn         *sql.DB
+	S3Client       *s3.Client
+	BucketName     string
+	Region         string
+	Scoring        models.ScoringRule // how match results turn into points, the default rule when nil
+	Hub            *Hub               // tells the clients following a match about its new events
+	JwtSecret      []byte             // signs the tokens of the users
+	RateLimitStore RateLimitStore     // keeps the rate limit buckets of the clients, no limits when nil
+	RateLimits     RateLimits         // of each route group, per client
+	TrustedProxies []string           // that may tell the IP of the client in X-Forwarded-For, none when empty
+
+	AllowPrivateWebhooks bool // lets webhooks reach loopback, link-local and private addresses, such as test servers
 }
 
 func (h Handler) CreateBucket(ctx context.Context) error {
@@ -31,6 +41,14 @@ func (h Handler) CreateBucket(ctx context.Context) error {
 	return err
 }
 
+// CloseStorage closes the idle connections of the storage client, once
+// nothing uses it anymore.
+func (h Handler) CloseStorage() {
+	if client, ok := h.S3Client.Options().HTTPClient.(interface{ CloseIdleConnections() }); ok {
+		client.CloseIdleConnections()
+	}
+}
+
 func (h Handler) DeleteBucket(ctx context.Context) error {
 	_, err := h.S3Client.DeleteBucket(ctx, &s3.DeleteBucketInput{
 		Bucket: aws.String(h.BucketName),
@@ -40,13 +58,15 @@ func (h Handler) DeleteBucket(ctx context.Context) error {
 }
 
 func (h Handler) bucketExists(ctx context.Context) bool {
+	return h.checkStorage(ctx) == nil
+}
+
+// checkStorage tells whether the bucket is reachable.
+func (h Handler) checkStorage(ctx context.Context, optFns ...func(*s3.Options)) error {
 	_, err := h.S3Client.HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(h.BucketName),
-	})
-	if err != nil {
-		return false
-	}
-	return true
+	}, optFns...)
+	return err
 }
 
 func (h Handler) createPresignedUrl(ctx context.Context, objectKey string) (string, error) {
@@ -68,3 +88,9 @@ func (h Handler) deleteObject(ctx context.Context, objectKey string) error {
 	})
 	return err
 }
+
+// profilePictureUrl is where the profile picture of a player is served from
+// once uploaded.
+func (h Handler) profilePictureUrl(id int, name string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%d_%s", h.BucketName, h.Region, id, name)
+}
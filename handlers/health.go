@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// checkTimeout bounds each readiness check, so a dependency that hangs fails
+// the check rather than the probe.
+const checkTimeout = 2 * time.Second
+
+// Readiness tells whether the API is ready to serve, and how each of its
+// dependencies is.
+type Readiness struct {
+	Status string                 `json:"status"` // "ok" when every check is
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is how a dependency is, and how long it took to tell.
+type CheckResult struct {
+	Status     string  `json:"status"` // "ok" or "failed"
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// readinessChecks are the dependencies checked for readiness, by name.
+func (h Handler) readinessChecks() map[string]func(context.Context) error {
+	return map[string]func(context.Context) error{
+		"database": h.DbConn.PingContext,
+		"migrations": func(ctx context.Context) error {
+			pending, err := models.PendingMigrations(ctx, h.DbConn)
+			if err != nil {
+				return err
+			} else if len(pending) > 0 {
+				return fmt.Errorf("pending: %s", strings.Join(pending, ", "))
+			}
+			return nil
+		},
+		"storage": func(ctx context.Context) error {
+			// A probe wants how the storage is now, not after retries
+			return h.checkStorage(ctx, func(o *s3.Options) { o.RetryMaxAttempts = 1 })
+		},
+	}
+}
+
+// Ready runs the readiness checks at once.
+func (h Handler) Ready(ctx context.Context) Readiness {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	readiness := Readiness{Status: "ok", Checks: map[string]CheckResult{}}
+
+	for name, check := range h.readinessChecks() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			if err == nil && checkCtx.Err() != nil {
+				err = errors.New("timed out")
+			}
+			result := CheckResult{Status: "ok", DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+				readiness.Status = "failed"
+			}
+			readiness.Checks[name] = result
+		}()
+	}
+	wg.Wait()
+	return readiness
+}
+
+// @Summary Liveness
+// @Description Tell that the process serves requests, whatever its dependencies.
+// @Tags health
+// @Produce json
+// @Success 200 {object} gin.H
+// @Router /healthz [get]
+func (h Handler) GetHealthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// @Summary Readiness
+// @Description Check the database, its migrations and the storage, with how long each check took. Not ready while any of them fails.
+// @Tags health
+// @Produce json
+// @Success 200 {object} Readiness
+// @Failure 503 {object} Readiness
+// @Router /readyz [get]
+func (h Handler) GetReadyz(ctx *gin.Context) {
+	readiness := h.Ready(ctx.Request.Context())
+	if readiness.Status != "ok" {
+		ctx.JSON(http.StatusServiceUnavailable, readiness)
+		return
+	}
+	ctx.JSON(http.StatusOK, readiness)
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"sync"
+)
+
+// Hub tells the clients following a match that it has new events. It only
+// carries the news, the events themselves are read from the match history, so
+// a client that falls behind or reconnects catches up from where it was.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan struct{}]struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[int]map[chan struct{}]struct{}{}, closed: make(chan struct{})}
+}
+
+// Close tells the clients following matches to stop, as the server shuts down
+// and would otherwise wait on streams that never end.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// Closed is closed once the hub is.
+func (h *Hub) Closed() <-chan struct{} {
+	return h.closed
+}
+
+// Subscribe returns a channel that receives a value whenever the match has new
+// events, and the function to call once done with it.
+func (h *Hub) Subscribe(matchId int) (<-chan struct{}, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A single buffered value is enough, the subscriber reads every new event
+	// when it wakes up
+	ch := make(chan struct{}, 1)
+	if h.subscribers[matchId] == nil {
+		h.subscribers[matchId] = map[chan struct{}]struct{}{}
+	}
+	h.subscribers[matchId][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subscribers[matchId], ch)
+		if len(h.subscribers[matchId]) == 0 {
+			delete(h.subscribers, matchId)
+		}
+	}
+}
+
+// Publish wakes up the subscribers of the match. It never blocks, a subscriber
+// that hasn't read the last news yet will see these events along with those.
+func (h *Hub) Publish(matchId int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[matchId] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
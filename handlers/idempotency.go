@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyKeyRetention is how long the response to an Idempotency-Key is
+// kept for retries.
+const IdempotencyKeyRetention = 24 * time.Hour
+
+// recordingWriter keeps a copy of the body written to the client.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotent is a middleware that makes a POST safe to retry. The first
+// response to a request with an Idempotency-Key header is stored and given
+// again to any retry with the same key and body by the same user or API key,
+// for IdempotencyKeyRetention. Server errors aren't stored, so those requests
+// can be retried for real.
+func (h Handler) Idempotent(ctx *gin.Context) {
+	var err error
+	var body []byte
+	var key = ctx.GetHeader("Idempotency-Key")
+	var caller = currentPrincipal(ctx).id()
+	var route = ctx.Request.Method + " " + ctx.FullPath()
+
+	if key == "" {
+		ctx.Next()
+		return
+	}
+	body, err = io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(hash[:])
+
+	stored, reserved, err := models.ReserveIdempotencyKey(ctx, h.DbConn, key, caller, route, requestHash, time.Now().Add(-IdempotencyKeyRetention))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	if !reserved {
+		if stored.RequestHash != requestHash {
+			respondProblem(ctx, models.NewProblem(http.StatusUnprocessableEntity, "request.idempotency_key_reused", "Idempotency-Key was already used for a different request"))
+		} else if stored.Status == 0 {
+			respondProblem(ctx, models.NewProblem(http.StatusConflict, "request.in_progress", "A request with this Idempotency-Key is still in progress"))
+		} else {
+			ctx.Header("Idempotent-Replayed", "true")
+			ctx.Data(stored.Status, stored.ContentType, stored.Body)
+			ctx.Abort()
+		}
+		return
+	}
+
+	// The key is stored or released even when the client is gone or the
+	// handler panics, else its retries would be refused until it expires
+	work := context.WithoutCancel(ctx)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if _, err := models.ReleaseIdempotencyKey(work, h.DbConn, key, caller, route); err != nil {
+				slog.ErrorContext(ctx, "Could not release idempotency key", "error", err)
+			}
+			panic(recovered)
+		}
+	}()
+
+	writer := &recordingWriter{ResponseWriter: ctx.Writer}
+	ctx.Writer = writer
+	ctx.Next()
+
+	if writer.Status() >= http.StatusInternalServerError {
+		_, err = models.ReleaseIdempotencyKey(work, h.DbConn, key, caller, route)
+	} else {
+		_, err = models.SaveIdempotentResponse(work, h.DbConn, models.IdempotentResponse{
+			Key:         key,
+			Principal:   caller,
+			Route:       route,
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not store idempotent response", "error", err)
+	}
+}
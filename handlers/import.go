@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	csvType    = "text/csv"
+	ndjsonType = "application/x-ndjson"
+
+	// MaxImportRows keeps a single import small enough to run in one
+	// transaction.
+	MaxImportRows = 5000
+)
+
+var errUnsupportedImport = models.NewProblem(http.StatusUnsupportedMediaType, "request.unsupported_media_type", "Import must be text/csv or application/x-ndjson")
+
+var errTooManyRows = models.NewProblem(http.StatusRequestEntityTooLarge, "import.too_many_rows", fmt.Sprintf("Import at most %d rows at once", MaxImportRows))
+
+type importQuery struct {
+	Mode string `form:"mode" binding:"omitempty,oneof=atomic bestEffort"`
+}
+
+// atomic tells whether the import must create every row or none.
+func (q importQuery) atomic() bool {
+	return q.Mode != "bestEffort"
+}
+
+// readImport decodes the request body into one value per row. CSV bodies start
+// with a header row naming the fields as in JSON, NDJSON bodies have one JSON
+// object per line. Every value is validated like a request body would be, the
+// rows that aren't valid are reported as failed.
+func readImport[T any](ctx *gin.Context) ([]T, []models.ImportRow, error) {
+	var values []T
+	var rows []models.ImportRow
+
+	add := func(value T, err error) error {
+		if err == nil {
+			err = binding.Validator.ValidateStruct(&value)
+		}
+		row := models.ImportRow{Row: len(rows) + 1}
+		if err != nil {
+			row.Fail(clientProblem(err))
+		}
+		values = append(values, value)
+		rows = append(rows, row)
+		if len(rows) > MaxImportRows {
+			return errTooManyRows
+		}
+		return nil
+	}
+
+	switch ctx.ContentType() {
+	case csvType:
+		reader := csv.NewReader(ctx.Request.Body)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+		for {
+			var value T
+			var parseErr *csv.ParseError
+
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil && !errors.As(err, &parseErr) {
+				return nil, nil, err
+			} else if err == nil {
+				form := map[string][]string{}
+				for i, field := range header {
+					form[field] = []string{record[i]}
+				}
+				err = binding.MapFormWithTag(&value, form, "json")
+			}
+			err = add(value, err)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	case ndjsonType:
+		scanner := bufio.NewScanner(ctx.Request.Body)
+		for scanner.Scan() {
+			var value T
+
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			err := add(value, json.Unmarshal(line, &value))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, errUnsupportedImport
+	}
+
+	return values, rows, nil
+}
+
+// respondImport answers with the report of the import, as an error when an
+// atomic import was rolled back.
+func respondImport(ctx *gin.Context, rows []models.ImportRow, atomic bool) {
+	report := models.NewImportReport(rows)
+	if atomic && report.Failed > 0 {
+		ctx.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+	ctx.JSON(http.StatusOK, report)
+}
+
+// @Summary Import players
+// @Description Create players from a CSV file with a header row naming the fields, or from NDJSON. An atomic import creates no player unless every row is valid, a best effort one creates the valid rows.
+// @Tags import
+// @Accept text/csv,application/x-ndjson
+// @Produce json
+// @Param mode query string false "atomic (default) or bestEffort"
+// @Param players body string true "Players, one per row"
+// @Success 200 {object} models.ImportReport
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 413 {object} models.Problem
+// @Failure 415 {object} models.Problem
+// @Failure 422 {object} models.ImportReport
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /import/players [post]
+func (h Handler) ImportPlayers(ctx *gin.Context) {
+	var err error
+	var query importQuery
+	var players []models.Player
+	var rows []models.ImportRow
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	players, rows, err = readImport[models.Player](ctx)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	err = models.ImportPlayers(ctx, h.DbConn, players, rows, query.atomic(), h.profilePictureUrl, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	respondImport(ctx, rows, query.atomic())
+}
+
+// @Summary Import matches
+// @Description Create matches from a CSV file with a header row naming the fields, or from NDJSON. Every match is checked like a single one, against the matches before it too. An atomic import creates no match unless every row is valid, a best effort one creates the valid rows.
+// @Tags import
+// @Accept text/csv,application/x-ndjson
+// @Produce json
+// @Param mode query string false "atomic (default) or bestEffort"
+// @Param matches body string true "Matches, one per row"
+// @Success 200 {object} models.ImportReport
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 413 {object} models.Problem
+// @Failure 415 {object} models.Problem
+// @Failure 422 {object} models.ImportReport
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /import/matches [post]
+func (h Handler) ImportMatches(ctx *gin.Context) {
+	var err error
+	var query importQuery
+	var matches []models.Match
+	var rows []models.ImportRow
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	matches, rows, err = readImport[models.Match](ctx)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	err = models.ImportMatches(ctx, h.DbConn, matches, rows, query.atomic(), actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	for _, row := range rows {
+		if row.Status == models.ImportCreated {
+			h.Hub.Publish(row.Id)
+		}
+	}
+	respondImport(ctx, rows, query.atomic())
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// heartbeatInterval keeps idle streams from being dropped by proxies.
+	heartbeatInterval = 15 * time.Second
+	writeTimeout      = 10 * time.Second
+)
+
+// upgrader accepts scoreboards served from any origin, as match events are
+// public anyway.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// lastEventId returns the id of the last event the client got before it
+// reconnected, from the Last-Event-ID header or, for clients that can't set
+// it, the lastEventId query parameter.
+func lastEventId(ctx *gin.Context) (int, error) {
+	value := ctx.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = ctx.Query("lastEventId")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, models.NewProblem(http.StatusBadRequest, "request.invalid_last_event_id", "Last-Event-ID must be the id of an event")
+	}
+	return id, nil
+}
+
+// followMatch sends the events of the match that happened after lastId, then
+// every new one as it happens, until done is closed, the hub is closed or
+// sending fails.
+func (h Handler) followMatch(ctx context.Context, done <-chan struct{}, matchId int, lastId int, send func(models.MatchEvent) error, heartbeat func() error) error {
+	news, unsubscribe := h.Hub.Subscribe(matchId)
+	defer unsubscribe()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		events, err := models.SelectMatchEventsAfter(ctx, h.DbConn, matchId, lastId)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			err = send(event)
+			if err != nil {
+				return err
+			}
+			lastId = event.Id
+		}
+		for waiting := true; waiting; {
+			select {
+			case <-done:
+				return nil
+			case <-h.Hub.Closed():
+				return nil
+			case <-news:
+				waiting = false
+			case <-ticker.C:
+				err = heartbeat()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// @Summary Follow match
+// @Description Stream the events of a match as Server-Sent Events, from its history first and then live. A client that reconnects with Last-Event-ID only gets the events it missed.
+// @Tags matches
+// @Produce text/event-stream
+// @Param id path string true "Match ID"
+// @Param Last-Event-ID header int false "Id of the last event received"
+// @Param lastEventId query int false "Id of the last event received, for clients that can't set headers"
+// @Success 200 {array} models.MatchEvent
+// @Failure 400 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /matches/{id}/events [get]
+func (h Handler) GetMatchEvents(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var match models.Match
+	var lastId int
+
+	match, err = models.SelectMatchById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	lastId, err = lastEventId(ctx)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	// Streams outlive the write timeout of the server
+	http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{})
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	err = h.followMatch(ctx, ctx.Request.Context().Done(), match.Id, lastId, func(event models.MatchEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(ctx.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+		ctx.Writer.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(ctx.Writer, ": heartbeat\n\n")
+		ctx.Writer.Flush()
+		return err
+	})
+	if err != nil {
+		slog.InfoContext(ctx, "Match events stream ended", "error", err)
+	}
+}
+
+// @Summary Follow match over a WebSocket
+// @Description Send the events of a match as JSON messages over a WebSocket, from its history first and then live. A scoreboard that reconnects with lastEventId only gets the events it missed.
+// @Tags matches
+// @Param id path string true "Match ID"
+// @Param lastEventId query int false "Id of the last event received"
+// @Success 101
+// @Failure 400 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /matches/{id}/ws [get]
+func (h Handler) GetMatchEventsWebSocket(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var match models.Match
+	var lastId int
+	var conn *websocket.Conn
+
+	match, err = models.SelectMatchById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	lastId, err = lastEventId(ctx)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	conn, err = upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// The upgrader already answered with the error
+		return
+	}
+	defer conn.Close()
+
+	// Scoreboards don't send anything, reading only notices when they go away
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = h.followMatch(ctx, done, match.Id, lastId, func(event models.MatchEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(event)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+	})
+	if err != nil {
+		slog.InfoContext(ctx, "Match events WebSocket ended", "error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+
+	"example.com/m/v2/models"
+)
+
+type loadersKey struct{}
+
+// loaders batch the reads made while resolving a GraphQL query. Resolvers ask
+// for what they need and get a thunk, the executor calls the thunks once every
+// field at the same depth is resolved, so the first call loads what all of them
+// asked for with one query.
+type loaders struct {
+	ctx    context.Context // of the query
+	h      Handler
+	caller principal // who made the query
+
+	pendingPlayers map[int]bool
+	players        map[int]*models.Player // nil for the ids that don't exist
+
+	pendingMatches  map[int]bool
+	matchesByPlayer map[int][]models.Match
+
+	standings map[int]models.Standing // built on first use
+}
+
+func newLoaders(ctx context.Context, h Handler, caller principal) *loaders {
+	return &loaders{
+		ctx:             ctx,
+		h:               h,
+		caller:          caller,
+		pendingPlayers:  map[int]bool{},
+		players:         map[int]*models.Player{},
+		pendingMatches:  map[int]bool{},
+		matchesByPlayer: map[int][]models.Match{},
+	}
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+// player returns a thunk of the player with id, or of nil when there is none.
+func (l *loaders) player(id int) func() (any, error) {
+	if _, ok := l.players[id]; !ok && id != 0 {
+		l.pendingPlayers[id] = true
+	}
+	return func() (any, error) {
+		if len(l.pendingPlayers) > 0 {
+			ids := make([]int, 0, len(l.pendingPlayers))
+			for id := range l.pendingPlayers {
+				ids = append(ids, id)
+				l.players[id] = nil
+			}
+			l.pendingPlayers = map[int]bool{}
+			players, err := models.SelectPlayersByIds(l.ctx, l.h.DbConn, ids)
+			if err != nil {
+				return nil, graphqlError(l.ctx, err)
+			}
+			for i := range players {
+				l.players[players[i].Id] = &players[i]
+			}
+		}
+		if player := l.players[id]; player != nil {
+			return *player, nil
+		}
+		return nil, nil
+	}
+}
+
+// matches returns a thunk of the matches played by the player with id.
+func (l *loaders) matches(playerId int) func() (any, error) {
+	if _, ok := l.matchesByPlayer[playerId]; !ok {
+		l.pendingMatches[playerId] = true
+	}
+	return func() (any, error) {
+		if len(l.pendingMatches) > 0 {
+			ids := make([]int, 0, len(l.pendingMatches))
+			for id := range l.pendingMatches {
+				ids = append(ids, id)
+				l.matchesByPlayer[id] = []models.Match{}
+			}
+			l.pendingMatches = map[int]bool{}
+			matches, err := models.SelectMatchesByPlayerIds(l.ctx, l.h.DbConn, ids)
+			if err != nil {
+				return nil, graphqlError(l.ctx, err)
+			}
+			for _, match := range matches {
+				for _, id := range []int{match.Player1id, match.Player2id} {
+					if _, ok := l.matchesByPlayer[id]; ok {
+						l.matchesByPlayer[id] = append(l.matchesByPlayer[id], match)
+					}
+				}
+			}
+		}
+		return l.matchesByPlayer[playerId], nil
+	}
+}
+
+// standing returns the standing of the player with id, or nil when the player
+// hasn't played yet. The standings are replayed once per query.
+func (l *loaders) standing(playerId int) (any, error) {
+	if l.standings == nil {
+		projection, err := models.ReplayMatchEvents(l.ctx, l.h.DbConn, l.h.Scoring)
+		if err != nil {
+			return nil, graphqlError(l.ctx, err)
+		}
+		l.standings = map[int]models.Standing{}
+		for _, standing := range projection.Standings() {
+			l.standings[standing.PlayerId] = standing
+		}
+	}
+	if standing, ok := l.standings[playerId]; ok {
+		return standing, nil
+	}
+	return nil, nil
+}
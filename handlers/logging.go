@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIdHeader carries the id of a request, forwarded by the client or a
+// proxy, or else given by the API.
+const requestIdHeader = "X-Request-ID"
+
+type requestIdKey struct{}
+
+// NewLogger returns a JSON logger of the records at level and above. Records
+// logged with the context of a request carry its id as request_id.
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(requestIdHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// requestIdHandler adds the id of the request to the records logged with its
+// context.
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestId returns the id of the request ctx belongs to, empty outside of
+// requests.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// requestIdOf returns the id forwarded for a request when it is usable, or a
+// new one. Forwarded ids are kept short and plain, so they can't pass for
+// something else in the logs.
+func requestIdOf(forwarded string) string {
+	if len(forwarded) > 0 && len(forwarded) <= 128 && strings.Trim(forwarded, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:") == "" {
+		return forwarded
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// AssignRequestId gives the request the id forwarded in X-Request-ID, or a new
+// one, and answers with it.
+func AssignRequestId(ctx *gin.Context) {
+	id := requestIdOf(ctx.GetHeader(requestIdHeader))
+	ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), requestIdKey{}, id))
+	ctx.Header(requestIdHeader, id)
+	ctx.Next()
+}
+
+// LogRequests logs every request once answered, internal errors as errors.
+func LogRequests(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	level := slog.LevelInfo
+	if ctx.Writer.Status() == http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.LogAttrs(ctx, level, "Request",
+		slog.String("method", ctx.Request.Method),
+		slog.String("path", ctx.Request.URL.Path),
+		slog.Int("status", ctx.Writer.Status()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("client_ip", ctx.ClientIP()),
+		slog.String("principal", currentPrincipal(ctx).name()),
+	)
+}
+
+// Recover answers the requests whose handler panicked with an internal error,
+// logging the panic. Use it with gin.CustomRecoveryWithWriter.
+func Recover(ctx *gin.Context, recovered any) {
+	respondProblem(ctx, fmt.Errorf("panic: %v\n%s", recovered, debug.Stack()))
+}
+
+// recoverGrpc answers the calls whose handler panicked with an internal
+// error, logging the panic, as Recover does for REST.
+func recoverGrpc(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res any, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = grpcError(ctx, fmt.Errorf("panic: %v\n%s", recovered, debug.Stack()))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// recoverGrpcStream is recoverGrpc for streaming calls.
+func recoverGrpcStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = grpcError(stream.Context(), fmt.Errorf("panic: %v\n%s", recovered, debug.Stack()))
+		}
+	}()
+	return handler(srv, stream)
+}
+
+// grpcRequestId gives the call the id forwarded in x-request-id metadata, or
+// a new one, and answers with it in the header.
+func grpcRequestId(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := requestIdOf(firstValue(md, strings.ToLower(requestIdHeader)))
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIdHeader), id))
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// logGrpc gives the call a request id and logs it once answered, as
+// AssignRequestId and LogRequests do for REST.
+func logGrpc(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx = grpcRequestId(ctx)
+	res, err := handler(ctx, req)
+	logGrpcCall(ctx, info.FullMethod, err, start)
+	return res, err
+}
+
+// logGrpcStream is logGrpc for streaming calls.
+func logGrpcStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := grpcRequestId(stream.Context())
+	err := handler(srv, contextStream{stream, ctx})
+	logGrpcCall(ctx, info.FullMethod, err, start)
+	return err
+}
+
+func logGrpcCall(ctx context.Context, method string, err error, start time.Time) {
+	level := slog.LevelInfo
+	if status.Code(err) == codes.Internal {
+		level = slog.LevelError
+	}
+	slog.LogAttrs(ctx, level, "gRPC call",
+		slog.String("method", method),
+		slog.String("code", status.Code(err).String()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("peer_ip", peerIp(ctx)),
+	)
+}
+
+// contextStream is a stream with a context of its own, such as one carrying
+// the id of the call.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
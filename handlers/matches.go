@@ -2,8 +2,8 @@ package handlers
 
 import (
 	"database/sql"
-	"errors"
 	"net/http"
+	"time"
 
 	"example.com/m/v2/models"
 	"github.com/gin-gonic/gin"
@@ -15,29 +15,42 @@ import (
 // @Accept json
 // @Produce json
 // @Param match body models.Match true "Match object"
+// @Param Idempotency-Key header string false "Unique key of the request, retries with the same key get the first response again"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} Idempotent-Replayed "true when the response is a replay"
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 422 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /matches [post]
 func (h Handler) PostMatch(ctx *gin.Context) {
 	var err error
 	var match models.Match
+	var res sql.Result
+	var id int64
 
 	err = ctx.ShouldBindJSON(&match)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid match data"})
+		badRequest(ctx, err)
+		return
+	}
+	res, err = match.Create(ctx, h.DbConn, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
 		return
 	}
-	_, err = match.Create(h.DbConn)
+	id, err = res.LastInsertId()
 	if err != nil {
-		var matchErr models.MatchError
-		if errors.As(err, &matchErr) {
-			ctx.JSON(matchErr.StatusCode, gin.H{"error": matchErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		respondProblem(ctx, err)
 		return
 	}
+	match.Id = int(id)
+	h.Hub.Publish(match.Id)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Match created successfully"})
 }
 
@@ -47,36 +60,63 @@ func (h Handler) PostMatch(ctx *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param status query string false "Match status"
+// @Param includeDeleted query bool false "Include soft deleted matches, for admins only"
+// @Param playerId query int false "Matches played by this player"
+// @Param tableNumber query int false "Matches played on this table"
+// @Param winnerId query int false "Matches won by this player"
+// @Param from query string false "Matches starting at or after this time (RFC 3339)"
+// @Param to query string false "Matches starting at or before this time (RFC 3339)"
+// @Param sort query string false "Sort by id, startTime or tableNumber, prefixed with - for descending order"
+// @Param limit query int false "Page size, 100 by default and at most 1000"
+// @Param cursor query string false "Cursor of the page to get, from the Link header of the previous one"
 // @Success 200 {object} []models.Match
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} Link "URL of the next page"
+// @Failure 400 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
 // @Router /matches [get]
 func (h Handler) GetMatches(ctx *gin.Context) {
 	var err error
 	var matches []models.Match
 	var query = struct {
-		Status string `form:"status"`
+		Status         string    `form:"status"`
+		IncludeDeleted bool      `form:"includeDeleted"`
+		PlayerId       int       `form:"playerId"`
+		TableNumber    *int      `form:"tableNumber"`
+		WinnerId       int       `form:"winnerId"`
+		From           time.Time `form:"from"`
+		To             time.Time `form:"to"`
+		pageQuery
 	}{}
 
 	err = ctx.ShouldBindQuery(&query)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(ctx, err)
 		return
-	} else if query.Status != "" {
-		matches, err = models.SelectMatchesByStatus(h.DbConn, query.Status)
-	} else {
-		matches, err = models.SelectAllMatches(h.DbConn)
 	}
-
+	err = deletedAllowed(currentPrincipal(ctx), query.IncludeDeleted)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	page := query.page()
+	matches, err = models.SelectMatches(ctx, h.DbConn, models.MatchFilter{
+		Status:         query.Status,
+		PlayerId:       query.PlayerId,
+		TableNumber:    query.TableNumber,
+		WinnerId:       query.WinnerId,
+		From:           query.From,
+		To:             query.To,
+		IncludeDeleted: query.IncludeDeleted,
+	}, page)
 	if err != nil {
-		var matchErr models.MatchError
-		if errors.As(err, &matchErr) {
-			ctx.JSON(matchErr.StatusCode, gin.H{"error": matchErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		respondProblem(ctx, err)
 		return
 	}
+	if len(matches) > 0 {
+		setNextLink(ctx, page, len(matches), matches[len(matches)-1])
+	}
 	ctx.JSON(http.StatusOK, matches)
 }
 
@@ -86,23 +126,25 @@ func (h Handler) GetMatches(ctx *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path string true "Match ID"
+// @Param If-None-Match header string false "ETag of the copy the client has"
 // @Success 200 {object} models.Match
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} ETag "Version of the match"
+// @Success 304
+// @Failure 400 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
 // @Router /matches/{id} [get]
 func (h Handler) GetMatch(ctx *gin.Context) {
 	var err error
 	var match models.Match
 	var id = ctx.Param("id")
 
-	match, err = models.SelectMatchById(h.DbConn, id)
+	match, err = models.SelectMatchById(ctx, h.DbConn, id)
 	if err != nil {
-		var matchErr models.MatchError
-		if errors.As(err, &matchErr) {
-			ctx.JSON(matchErr.StatusCode, gin.H{"error": matchErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		respondProblem(ctx, err)
+		return
+	}
+	if notModified(ctx, match.Version) {
 		return
 	}
 	ctx.JSON(http.StatusOK, match)
@@ -115,83 +157,190 @@ func (h Handler) GetMatch(ctx *gin.Context) {
 // @Produce json
 // @Param id path string true "Match ID"
 // @Param match body models.Match true "Match object"
+// @Param If-Match header string false "ETag of the version being updated"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /matches/{id} [put]
 func (h Handler) PutMatch(ctx *gin.Context) {
 	var err error
 	var id = ctx.Param("id")
+	var before models.Match
 	var match models.Match
+	var caller = currentPrincipal(ctx)
 
-	match, err = models.SelectMatchById(h.DbConn, id)
+	before, err = models.SelectMatchById(ctx, h.DbConn, id)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, before.Version) {
 		return
 	}
+	match = before
 	err = ctx.ShouldBindJSON(&match)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(ctx, err)
 		return
 	}
-	err = updateMatch(h.DbConn, id, match)
+	err = matchChangeAllowed(caller, before, match)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
+	match.Version = before.Version
+	err = models.RecordMatchResult(ctx, h.DbConn, id, match, h.Scoring, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	match.Version++
+	h.Hub.Publish(before.Id)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Match updated successfully"})
 }
 
+// @Summary Patch match
+// @Description Partially update match by id with a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// @Tags matches
+// @Accept application/merge-patch+json,application/json-patch+json
+// @Produce json
+// @Param id path string true "Match ID"
+// @Param patch body object true "Merge patch or JSON patch"
+// @Param If-Match header string false "ETag of the version being updated"
+// @Success 200 {object} models.Match
+// @Header 200 {string} ETag "Version of the match"
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 415 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /matches/{id} [patch]
+func (h Handler) PatchMatch(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var before models.Match
+	var match models.Match
+	var caller = currentPrincipal(ctx)
+
+	before, err = models.SelectMatchById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, before.Version) {
+		return
+	}
+	err = applyPatch(ctx, before, &match)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	match.Id = before.Id
+	match.Version = before.Version
+	err = matchChangeAllowed(caller, before, match)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	err = models.RecordMatchResult(ctx, h.DbConn, id, match, h.Scoring, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	match.Version++
+	h.Hub.Publish(before.Id)
+	ctx.Header("ETag", etag(match.Version))
+	ctx.JSON(http.StatusOK, match)
+}
+
 // @Summary Delete match
-// @Description Delete match by id
+// @Description Soft delete match by id, it can be restored until it is purged
 // @Tags matches
 // @Accept json
 // @Produce json
 // @Param id path string true "Match ID"
+// @Param If-Match header string false "ETag of the version being deleted"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /matches/{id} [delete]
 func (h Handler) DeleteMatch(ctx *gin.Context) {
 	var err error
 	var id = ctx.Param("id")
-	var res sql.Result
+	var match models.Match
 
-	res, err = models.DeleteMatchById(h.DbConn, id)
+	match, err = models.SelectMatchById(ctx, h.DbConn, id)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, match.Version) {
 		return
 	}
-	rowsAffected, err := res.RowsAffected()
+	_, err = models.DeleteMatchById(ctx, h.DbConn, id, match.Version, h.Scoring, actor(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	} else if rowsAffected == 0 {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": "Match not found"})
+		respondProblem(ctx, err)
 		return
 	}
+	h.Hub.Publish(match.Id)
 
 	ctx.JSON(http.StatusOK, gin.H{"message": "Match deleted successfully"})
 }
 
-func updateMatch(dbConn *sql.DB, id string, match models.Match) error {
+// @Summary Restore match
+// @Description Restore a soft deleted match by id, unless its table or players have been booked since
+// @Tags matches
+// @Accept json
+// @Produce json
+// @Param id path string true "Match ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /matches/{id}/restore [post]
+func (h Handler) RestoreMatch(ctx *gin.Context) {
 	var err error
-	var loserId int
+	var id = ctx.Param("id")
+	var res sql.Result
 
-	_, err = models.UpdateMatchById(dbConn, id, match)
+	res, err = models.RestoreMatchById(ctx, h.DbConn, id, h.Scoring, actor(ctx))
 	if err != nil {
-		return err
-	} else if match.WinnerId != 0 {
-		if match.WinnerId == match.Player1id {
-			loserId = match.Player2id
-		} else {
-			loserId = match.Player1id
-		}
-		err = models.UpdatePoints(dbConn, match.WinnerId, loserId)
-		if err != nil {
-			return err
-		}
+		respondProblem(ctx, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if rowsAffected == 0 {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "match.not_found", "Deleted match not found"))
+		return
+	}
+	match, err := models.SelectMatchById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
 	}
+	h.Hub.Publish(match.Id)
 
-	return nil
+	ctx.JSON(http.StatusOK, gin.H{"message": "Match restored successfully"})
 }
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pool_http_request_duration_seconds",
+		Help:    "Duration of the REST requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pool_storage_request_duration_seconds",
+		Help:    "Duration of the requests to the storage, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "outcome"})
+	metricsHandler = promhttp.Handler()
+)
+
+// ObserveRequests times the requests by route, as routed by setupRouter.
+// Requests no route matched are put together, so unknown paths don't make a
+// series each.
+func ObserveRequests(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	requestDuration.WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status())).Observe(time.Since(start).Seconds())
+}
+
+// ObserveStorage times every request the S3 client sends, retries included.
+// Add it to the APIOptions of the client. Presigning sends nothing, so it
+// isn't timed.
+func ObserveStorage(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("ObserveStorage", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		storageDuration.WithLabelValues(awsmiddleware.GetOperationName(ctx), outcome).Observe(time.Since(start).Seconds())
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// @Summary Metrics
+// @Description Prometheus metrics: request, database and storage durations, and domain counters.
+// @Tags health
+// @Produce plain
+// @Success 200 {string} string
+// @Router /metrics [get]
+func (h Handler) GetMetrics(ctx *gin.Context) {
+	metricsHandler.ServeHTTP(ctx.Writer, ctx.Request)
+}
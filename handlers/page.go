@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"fmt"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// pageQuery holds the pagination parameters shared by the list endpoints.
+type pageQuery struct {
+	Sort   string `form:"sort"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+	Cursor string `form:"cursor"`
+}
+
+func (q pageQuery) page() models.Page {
+	return models.Page{Sort: q.Sort, Limit: q.Limit, Cursor: q.Cursor}
+}
+
+// nextCursor returns the cursor of the page after the one of count rows, or ""
+// when it had less than a full page and was the last.
+func nextCursor(page models.Page, count int, last models.Sortable) string {
+	limit := page.Limit
+	if limit <= 0 || limit > models.MaxPageLimit {
+		limit = models.DefaultPageLimit
+	}
+	if count < limit {
+		return ""
+	}
+	return page.NextCursor(last)
+}
+
+// setNextLink points the client to the next page with a Link header, unless
+// this one was the last.
+func setNextLink(ctx *gin.Context, page models.Page, count int, last models.Sortable) {
+	cursor := nextCursor(page, count, last)
+	if cursor == "" {
+		return
+	}
+	next := *ctx.Request.URL
+	query := next.Query()
+	query.Set("cursor", cursor)
+	next.RawQuery = query.Encode()
+
+	ctx.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
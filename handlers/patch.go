@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"example.com/m/v2/models"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// errUnsupportedPatch is returned for a PATCH body that is neither kind of
+// patch.
+var errUnsupportedPatch = models.NewProblem(http.StatusUnsupportedMediaType, "request.unsupported_media_type", "Patch must be application/merge-patch+json or application/json-patch+json")
+
+// applyPatch applies the request body to current and decodes the outcome into
+// patched, which must start out empty so cleared fields end up zero. The body
+// is a JSON Patch (RFC 6902) when sent as application/json-patch+json and a
+// JSON Merge Patch (RFC 7396) otherwise. Validation runs on the patched value,
+// so a patch only needs the fields it changes.
+func applyPatch(ctx *gin.Context, current any, patched any) error {
+	var doc []byte
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return err
+	}
+	doc, err = json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	switch ctx.ContentType() {
+	case jsonPatchType:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return err
+		}
+		doc, err = patch.Apply(doc)
+		if err != nil {
+			return err
+		}
+	case mergePatchType, binding.MIMEJSON, "":
+		doc, err = jsonpatch.MergePatch(doc, body)
+		if err != nil {
+			return err
+		}
+	default:
+		return errUnsupportedPatch
+	}
+	err = json.Unmarshal(doc, patched)
+	if err != nil {
+		return err
+	}
+
+	return binding.Validator.ValidateStruct(patched)
+}
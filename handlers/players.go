@@ -3,7 +3,6 @@ package handlers
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"net/http"
 
@@ -17,49 +16,34 @@ import (
 // @Accept json
 // @Produce json
 // @Param player body models.Player true "Player object"
+// @Param Idempotency-Key header string false "Unique key of the request, retries with the same key get the first response again"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} Idempotent-Replayed "true when the response is a replay"
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 409 {object} models.Problem
+// @Failure 422 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /players [post]
 func (h Handler) PostPlayer(ctx *gin.Context) {
 	var err error
 	var player models.Player
-	var res sql.Result
-	var id int64
-	var presignedUrl string
 
 	err = ctx.ShouldBindJSON(&player)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid player data"})
-		return
-	}
-	res, err = player.Create(h.DbConn)
-	if err != nil {
-		var playerErr models.PlayerError
-		if errors.As(err, &playerErr) {
-			ctx.JSON(playerErr.StatusCode, gin.H{"error": playerErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		badRequest(ctx, err)
 		return
 	}
-	id, err = res.LastInsertId()
+	player, err = models.CreatePlayer(ctx, h.DbConn, player, h.profilePictureUrl, actor(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
-	presignedUrl, err = h.createPresignedUrl(context.TODO(), fmt.Sprintf("%d_%s", id, player.Name))
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	player.ProfilePictureUrl = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%d_%s", h.BucketName, h.Region, id, player.Name)
-	_, err = models.UpdatePlayerById(h.DbConn, fmt.Sprintf("%d", id), player)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Player created successfully, upload your profile picture to the following URL", "url": presignedUrl})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Player created successfully"})
 }
 
 // @Summary Get players
@@ -68,31 +52,45 @@ func (h Handler) PostPlayer(ctx *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param name query string false "Player name"
+// @Param includeDeleted query bool false "Include soft deleted players, for admins only"
+// @Param sort query string false "Sort by id, name, ranking or points, prefixed with - for descending order"
+// @Param limit query int false "Page size, 100 by default and at most 1000"
+// @Param cursor query string false "Cursor of the page to get, from the Link header of the previous one"
 // @Success 200 {array} models.Player
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} Link "URL of the next page"
+// @Failure 400 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
 // @Router /players [get]
 func (h Handler) GetPlayers(ctx *gin.Context) {
 	var err error
 	var players []models.Player
 	var query = struct {
-		Name string `form:"name"`
+		Name           string `form:"name"`
+		IncludeDeleted bool   `form:"includeDeleted"`
+		pageQuery
 	}{}
 
 	err = ctx.ShouldBindQuery(&query)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(ctx, err)
 		return
-	} else if query.Name != "" {
-		players, err = models.SelectPlayersByName(h.DbConn, query.Name)
-	} else {
-		players, err = models.SelectAllPlayers(h.DbConn)
 	}
-
+	err = deletedAllowed(currentPrincipal(ctx), query.IncludeDeleted)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	page := query.page()
+	players, err = models.SelectPlayers(ctx, h.DbConn, models.PlayerFilter{Name: query.Name, IncludeDeleted: query.IncludeDeleted}, page)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
+	if len(players) > 0 {
+		setNextLink(ctx, page, len(players), players[len(players)-1])
+	}
 	ctx.JSON(http.StatusOK, players)
 }
 
@@ -102,102 +100,222 @@ func (h Handler) GetPlayers(ctx *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path string true "Player ID"
+// @Param If-None-Match header string false "ETag of the copy the client has"
 // @Success 200 {object} models.Player
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Header 200 {string} ETag "Version of the player"
+// @Success 304
+// @Failure 400 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
 // @Router /players/{id} [get]
 func (h Handler) GetPlayer(ctx *gin.Context) {
 	var err error
 	var player models.Player
 	var id = ctx.Param("id")
 
-	player, err = models.SelectPlayerById(h.DbConn, id)
+	player, err = models.SelectPlayerById(ctx, h.DbConn, id)
 	if err != nil {
-		var playerErr models.PlayerError
-		if errors.As(err, &playerErr) {
-			ctx.JSON(playerErr.StatusCode, gin.H{"error": playerErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		respondProblem(ctx, err)
+		return
+	}
+	if notModified(ctx, player.Version) {
 		return
 	}
 	ctx.JSON(http.StatusOK, player)
 }
 
 // @Summary Put player
-// @Description Update player by id
+// @Description Update player by id, the user the player is also gets a URL to upload its profile picture to
 // @Tags players
 // @Accept json
 // @Produce json
 // @Param id path string true "Player ID"
 // @Param player body models.Player true "Player object"
+// @Param If-Match header string false "ETag of the version being updated"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /players/{id} [put]
 func (h Handler) PutPlayer(ctx *gin.Context) {
 	var err error
 	var id = ctx.Param("id")
+	var before models.Player
 	var player models.Player
+	var caller = currentPrincipal(ctx)
 	var presignedUrl string
 
-	player, err = models.SelectPlayerById(h.DbConn, id)
+	before, err = models.SelectPlayerById(ctx, h.DbConn, id)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, before.Version) {
 		return
 	}
+	player = before
 	err = ctx.ShouldBindJSON(&player)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(ctx, err)
+		return
+	}
+	player = player.WithStandingsOf(before)
+	err = playerChangeAllowed(caller, before, player)
+	if err != nil {
+		respondProblem(ctx, err)
 		return
 	}
-	_, err = models.UpdatePlayerById(h.DbConn, id, player)
+	player.Version = before.Version
+	_, err = models.UpdatePlayerById(ctx, h.DbConn, id, player, actor(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
+		return
+	}
+	player.Version++
+	// Only the user the player is gets to upload its picture
+	if !ownsPlayer(caller, before) {
+		ctx.JSON(http.StatusOK, gin.H{"message": "Player updated successfully"})
 		return
 	}
 	presignedUrl, err = h.createPresignedUrl(context.TODO(), fmt.Sprintf("%s_%s", id, player.Name))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Player updated successfully, you can update your profile picture using the following URL", "url": presignedUrl})
 }
 
+// @Summary Patch player
+// @Description Partially update player by id with a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// @Tags players
+// @Accept application/merge-patch+json,application/json-patch+json
+// @Produce json
+// @Param id path string true "Player ID"
+// @Param patch body object true "Merge patch or JSON patch"
+// @Param If-Match header string false "ETag of the version being updated"
+// @Success 200 {object} models.Player
+// @Header 200 {string} ETag "Version of the player"
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 415 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /players/{id} [patch]
+func (h Handler) PatchPlayer(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var before models.Player
+	var player models.Player
+	var caller = currentPrincipal(ctx)
+
+	before, err = models.SelectPlayerById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, before.Version) {
+		return
+	}
+	err = applyPatch(ctx, before, &player)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	player = player.WithStandingsOf(before)
+	player.Id = before.Id
+	player.Version = before.Version
+	err = playerChangeAllowed(caller, before, player)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	_, err = models.UpdatePlayerById(ctx, h.DbConn, id, player, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	player.Version++
+	ctx.Header("ETag", etag(player.Version))
+	ctx.JSON(http.StatusOK, player)
+}
+
 // @Summary Delete player
-// @Description Delete player by id
+// @Description Soft delete player by id, it can be restored until it is purged
 // @Tags players
 // @Accept json
 // @Produce json
 // @Param id path string true "Player ID"
+// @Param If-Match header string false "ETag of the version being deleted"
 // @Success 200 {object} gin.H
-// @Failure 400 {object} gin.H
-// @Failure 500 {object} gin.H
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 412 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
 // @Router /players/{id} [delete]
 func (h Handler) DeletePlayer(ctx *gin.Context) {
 	var err error
 	var id = ctx.Param("id")
 	var player models.Player
 
-	player, err = models.SelectPlayerById(h.DbConn, id)
+	player, err = models.SelectPlayerById(ctx, h.DbConn, id)
 	if err != nil {
-		var playerErr models.PlayerError
-		if errors.As(err, &playerErr) {
-			ctx.JSON(playerErr.StatusCode, gin.H{"error": playerErr.Err})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		respondProblem(ctx, err)
+		return
+	} else if !checkIfMatch(ctx, player.Version) {
 		return
 	}
-	_, err = models.DeletePlayerById(h.DbConn, id)
+	_, err = models.DeletePlayerById(ctx, h.DbConn, id, player.Version, actor(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
-	err = h.deleteObject(context.TODO(), fmt.Sprintf("%s_%s", id, player.Name))
+	ctx.JSON(http.StatusOK, gin.H{"message": "Player deleted successfully"})
+}
+
+// @Summary Restore player
+// @Description Restore a soft deleted player by id
+// @Tags players
+// @Accept json
+// @Produce json
+// @Param id path string true "Player ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Security ApiKeyAuth
+// @Router /players/{id}/restore [post]
+func (h Handler) RestorePlayer(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var res sql.Result
+
+	res, err = models.RestorePlayerById(ctx, h.DbConn, id, actor(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondProblem(ctx, err)
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Player deleted successfully"})
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if rowsAffected == 0 {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "player.not_found", "Deleted player not found"))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Player restored successfully"})
 }
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const problemType = "application/problem+json"
+
+func init() {
+	// Report invalid fields by the name the client used for them
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+				if name != "" && name != "-" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
+
+// respondProblem answers with err as an application/problem+json body. Errors
+// that aren't meant for clients are logged and reported as a bare internal
+// error, so no SQL or storage details leak.
+func respondProblem(ctx *gin.Context, err error) {
+	problem := toProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		slog.ErrorContext(ctx, "Internal error", "method", ctx.Request.Method, "path", ctx.Request.URL.Path, "error", err)
+	}
+	ctx.Header("Content-Type", problemType)
+	ctx.AbortWithStatusJSON(problem.Status, problem)
+}
+
+func toProblem(err error) models.Problem {
+	var problem models.Problem
+	var validationErrs validator.ValidationErrors
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	if errors.As(err, &problem) {
+		return problem
+	} else if errors.As(err, &validationErrs) {
+		problem = models.NewProblem(http.StatusBadRequest, "request.invalid", "Some fields are invalid")
+		for _, fieldErr := range validationErrs {
+			problem.Errors = append(problem.Errors, models.FieldError{
+				Field:  fieldErr.Field(),
+				Rule:   fieldErr.Tag(),
+				Detail: fmt.Sprintf("%s failed the %s rule", fieldErr.Field(), fieldErr.Tag()),
+			})
+		}
+		return problem
+	} else if errors.As(err, &typeErr) {
+		problem = models.NewProblem(http.StatusBadRequest, "request.invalid", "Some fields are invalid")
+		problem.Errors = []models.FieldError{{Field: typeErr.Field, Rule: "type", Detail: fmt.Sprintf("%s must be a %s", typeErr.Field, typeErr.Type)}}
+		return problem
+	} else if errors.As(err, &syntaxErr) {
+		return models.NewProblem(http.StatusBadRequest, "request.malformed", "Body is not valid JSON")
+	}
+
+	return models.NewProblem(http.StatusInternalServerError, "internal", "Something went wrong on our side")
+}
+
+// badRequest reports request parameters that couldn't be bound.
+func badRequest(ctx *gin.Context, err error) {
+	respondProblem(ctx, clientProblem(err))
+}
+
+// clientProblem converts an error caused by the request. Problems such as
+// validation failures keep their details, anything else is the client's fault
+// too.
+func clientProblem(err error) models.Problem {
+	problem := toProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		problem = models.NewProblem(http.StatusBadRequest, "request.invalid", err.Error())
+	}
+	return problem
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"example.com/m/v2/models"
+)
+
+// PurgeDeleted permanently removes the players and matches that were soft
+// deleted more than retention ago, along with the players' profile pictures.
+func (h Handler) PurgeDeleted(ctx context.Context, retention time.Duration) error {
+	var err error
+	var players []models.Player
+	var cutoff = time.Now().Add(-retention)
+
+	players, err = models.SelectPlayersDeletedBefore(ctx, h.DbConn, cutoff)
+	if err != nil {
+		return err
+	}
+	for _, player := range players {
+		err = h.deleteObject(ctx, fmt.Sprintf("%d_%s", player.Id, player.Name))
+		if err != nil {
+			return err
+		}
+		_, err = models.PurgePlayerById(ctx, h.DbConn, fmt.Sprintf("%d", player.Id))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = models.PurgeMatchesDeletedBefore(ctx, h.DbConn, cutoff)
+
+	return err
+}
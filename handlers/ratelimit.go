@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Route groups, limited separately. Signing in is limited the most, to slow
+// down password guessing. Every request to the API also takes from the bucket
+// of its IP before its credentials are checked, so bad tokens and keys are
+// limited too.
+const (
+	RateLimitAuth  = "auth"
+	RateLimitRead  = "read"
+	RateLimitWrite = "write"
+	RateLimitIp    = "ip"
+)
+
+var errRateLimited = models.NewProblem(http.StatusTooManyRequests, "rate_limit.exceeded", "Too many requests, retry later")
+
+// Limit is a token bucket of Requests tokens, refilled in Period. Clients may
+// send Requests requests at once, then Requests every Period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses a limit written as requests/period, such as "60/1m".
+func ParseLimit(value string) (Limit, error) {
+	requests, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q is not requests/period", value)
+	}
+	var limit Limit
+	var err error
+
+	limit.Requests, err = strconv.Atoi(requests)
+	if err != nil || limit.Requests < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive number of requests", value)
+	}
+	limit.Period, err = time.ParseDuration(period)
+	if err != nil || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive period", value)
+	}
+	return limit, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// RateLimits are the limits of each route group, per client. Groups without a
+// limit aren't limited.
+type RateLimits map[string]Limit
+
+// DefaultRateLimits are the limits unless configured otherwise.
+var DefaultRateLimits = RateLimits{
+	RateLimitAuth:  {Requests: 10, Period: time.Minute},
+	RateLimitRead:  {Requests: 300, Period: time.Minute},
+	RateLimitWrite: {Requests: 60, Period: time.Minute},
+	RateLimitIp:    {Requests: 600, Period: time.Minute},
+}
+
+// RateLimitResult tells whether a request was allowed, and what the client
+// has left.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request is allowed, when this one wasn't
+}
+
+// Bucket is the token bucket of a client. Stores keep one per client and key.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket for the time since it was last updated and takes a
+// token from it, if there is one. A new bucket starts full.
+func (b *Bucket) Take(limit Limit, now time.Time) RateLimitResult {
+	perSecond := float64(limit.Requests) / limit.Period.Seconds()
+	if b.Updated.IsZero() {
+		b.Tokens = float64(limit.Requests)
+	} else {
+		b.Tokens = math.Min(float64(limit.Requests), b.Tokens+now.Sub(b.Updated).Seconds()*perSecond)
+	}
+	b.Updated = now
+
+	result := RateLimitResult{Limit: limit}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsOf((1 - b.Tokens) / perSecond)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = secondsOf((float64(limit.Requests) - b.Tokens) / perSecond)
+	return result
+}
+
+// secondsOf rounds seconds up to whole seconds, as the headers tell them.
+func secondsOf(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds)) * time.Second
+}
+
+// RateLimitStore keeps the buckets of the clients. MemoryRateLimitStore keeps
+// them in the process, a store shared by the instances of the API, such as
+// one on Redis, holds clients to the same limits whichever instance they
+// reach. Take must refill and take from the bucket of key at once.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (RateLimitResult, error)
+}
+
+// MemoryRateLimitStore keeps the buckets in memory. Full buckets are
+// forgotten, as a new bucket starts full anyway.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	full time.Time // when the bucket is full again
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit Limit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	result := b.Take(limit, now)
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep forgets the full buckets, once a minute at most.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
+
+// clientLimit returns the bucket a request to group takes from, and its
+// limit. API keys have a single bucket of their own limit, shared by all the
+// groups, users one per group and anonymous clients one per group and IP. The
+// ip group is by IP whoever the client is.
+func (h Handler) clientLimit(group string, p principal, ip string) (string, Limit, bool) {
+	if group == RateLimitIp {
+		limit, ok := h.RateLimits[group]
+		return "ip:" + ip, limit, ok
+	} else if p.apiKey != nil {
+		return fmt.Sprintf("apikey:%d", p.apiKey.Id), Limit{Requests: p.apiKey.RateLimit, Period: time.Minute}, true
+	}
+	limit, ok := h.RateLimits[group]
+	if !ok {
+		return "", Limit{}, false
+	} else if p.user != nil {
+		return fmt.Sprintf("%s:user:%d", group, p.user.Id), limit, true
+	}
+	return group + ":ip:" + ip, limit, true
+}
+
+// takeRequest takes a request to group from the bucket of the client. When
+// the store fails, the request is let through rather than failing the API.
+func (h Handler) takeRequest(ctx context.Context, group string, p principal, ip string) (RateLimitResult, bool) {
+	if h.RateLimitStore == nil {
+		return RateLimitResult{}, false
+	}
+	key, limit, ok := h.clientLimit(group, p, ip)
+	if !ok {
+		return RateLimitResult{}, false
+	}
+	result, err := h.RateLimitStore.Take(ctx, key, limit, time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "Could not check rate limit", "error", err)
+		return RateLimitResult{}, false
+	}
+	return result, true
+}
+
+// RateLimit holds the clients of the route group to its limit, and tells them
+// where they stand in RateLimit-* headers. It goes after Authenticate or
+// Identify, to know the client, but for the ip group which goes before them.
+func (h Handler) RateLimit(group string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		result, ok := h.takeRequest(ctx, group, currentPrincipal(ctx), ctx.ClientIP())
+		if !ok {
+			ctx.Next()
+			return
+		}
+		ctx.Header("RateLimit-Limit", strconv.Itoa(result.Limit.Requests))
+		ctx.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		ctx.Header("RateLimit-Reset", strconv.Itoa(int(result.Reset.Seconds())))
+		ctx.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Limit.Requests, int(result.Limit.Period.Seconds())))
+		if !result.Allowed {
+			ctx.Header("Retry-After", strconv.Itoa(int(result.RetryAfter.Seconds())))
+			respondProblem(ctx, errRateLimited)
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Get standings
+// @Description Get the standings, rebuilt from the match history
+// @Tags standings
+// @Accept json
+// @Produce json
+// @Success 200 {array} models.Standing
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Router /standings [get]
+func (h Handler) GetStandings(ctx *gin.Context) {
+	projection, err := models.ReplayMatchEvents(ctx, h.DbConn, h.Scoring)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, projection.Standings())
+}
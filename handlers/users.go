@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Get users
+// @Description Get all users with their roles
+// @Tags users
+// @Accept json
+// @Produce json
+// @Success 200 {array} models.User
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /users [get]
+func (h Handler) GetUsers(ctx *gin.Context) {
+	users, err := models.SelectUsers(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, users)
+}
+
+// @Summary Put user
+// @Description Give a user a role, and the player it is if any. Organisers create matches and players, referees record results and players change the preferred cue of their own player only. Admins may do anything.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param access body models.UserAccess true "Role and player of the user"
+// @Success 200 {object} models.User
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /users/{id} [put]
+func (h Handler) PutUser(ctx *gin.Context) {
+	var err error
+	var id int
+	var access models.UserAccess
+	var user models.User
+
+	id, err = strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "user.not_found", "User not found"))
+		return
+	}
+	user, err = models.SelectUserById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	err = ctx.ShouldBindJSON(&access)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	if access.PlayerId != nil {
+		_, err = models.SelectPlayerById(ctx, h.DbConn, strconv.Itoa(*access.PlayerId))
+		if err != nil {
+			respondProblem(ctx, err)
+			return
+		}
+	}
+	err = models.UpdateUserAccess(ctx, h.DbConn, id, access, actor(ctx))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	user.Role = access.Role
+	user.PlayerId = access.PlayerId
+	ctx.JSON(http.StatusOK, user)
+}
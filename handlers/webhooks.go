@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"example.com/m/v2/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MaxWebhookAttempts is how many times a delivery is tried before it is
+	// dead, about two hours after the event.
+	MaxWebhookAttempts = 10
+	webhookRetryDelay  = 15 * time.Second
+	// webhookConcurrency is how many deliveries a webhook gets at once.
+	webhookConcurrency = 4
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookBackoff is how long to wait after the given failed attempt, doubling
+// every time.
+func webhookBackoff(attempts int) time.Duration {
+	return webhookRetryDelay << (attempts - 1)
+}
+
+// signWebhook returns the signature of a delivery made at timestamp, the hex
+// HMAC-SHA256 of "timestamp.body" keyed with the webhook secret. Subscribers
+// compute it the same way to check the delivery came from us.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverWebhooks sends the deliveries that are due. Webhooks get them at
+// the same time, each at most webhookConcurrency at once, so a slow one doesn't
+// hold back the others. Failed ones are tried again later, until they run out
+// of attempts.
+func (h Handler) DeliverWebhooks(ctx context.Context) error {
+	deliveries, err := models.SelectDueDeliveries(ctx, h.DbConn, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	slots := map[int]chan struct{}{}
+	for _, delivery := range deliveries {
+		slot, ok := slots[delivery.WebhookId]
+		if !ok {
+			slot = make(chan struct{}, webhookConcurrency)
+			slots[delivery.WebhookId] = slot
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slot <- struct{}{}
+			defer func() { <-slot }()
+			err := h.deliverWebhook(ctx, delivery)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// deliverWebhook sends a delivery and records how it went.
+func (h Handler) deliverWebhook(ctx context.Context, delivery models.WebhookDelivery) error {
+	var err error
+
+	deliveryErr := sendWebhook(ctx, delivery)
+	if deliveryErr == nil {
+		_, err = models.MarkDeliveryDelivered(ctx, h.DbConn, delivery.Id)
+	} else {
+		attempts := delivery.Attempts + 1
+		_, err = models.MarkDeliveryFailed(ctx, h.DbConn, delivery.Id, deliveryErr, time.Now().Add(webhookBackoff(attempts)), attempts >= MaxWebhookAttempts)
+	}
+
+	return err
+}
+
+func sendWebhook(ctx context.Context, delivery models.WebhookDelivery) error {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", fmt.Sprintf("%d", delivery.Id))
+	req.Header.Set("X-Webhook-Timestamp", fmt.Sprintf("%d", timestamp))
+	req.Header.Set("X-Webhook-Signature", signWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+
+	return nil
+}
+
+var errPrivateWebhookUrl = models.NewProblem(http.StatusBadRequest, "webhook.private_url", "Webhook URL must not point to a loopback, link-local or private address")
+
+// checkWebhookUrl refuses the URLs whose host is, or resolves to, a loopback,
+// link-local or private address, so webhooks can't be used to reach the
+// services next to the API.
+func (h Handler) checkWebhookUrl(ctx context.Context, rawUrl string) error {
+	if h.AllowPrivateWebhooks {
+		return nil
+	}
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return clientProblem(err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return models.NewProblem(http.StatusBadRequest, "webhook.unresolved_url", "Webhook URL host can't be resolved")
+	}
+	for _, ip := range ips {
+		if ip.IP.IsLoopback() || ip.IP.IsLinkLocalUnicast() || ip.IP.IsLinkLocalMulticast() || ip.IP.IsPrivate() || ip.IP.IsUnspecified() {
+			return errPrivateWebhookUrl
+		}
+	}
+	return nil
+}
+
+// @Summary Post webhook
+// @Description Subscribe a URL to events, which must not point to a loopback, link-local or private address. Deliveries are POSTed as JSON with an X-Webhook-Signature header, the hex HMAC-SHA256 of the X-Webhook-Timestamp header, a dot and the body, keyed with the secret. The secret is generated when not given and only shown in this response.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhook body models.Webhook true "Webhook object"
+// @Success 200 {object} models.Webhook
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /webhooks [post]
+func (h Handler) PostWebhook(ctx *gin.Context) {
+	var err error
+	var webhook models.Webhook
+
+	err = ctx.ShouldBindJSON(&webhook)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	err = h.checkWebhookUrl(ctx, webhook.Url)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			respondProblem(ctx, err)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	_, err = webhook.Create(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, webhook)
+}
+
+// @Summary Get webhooks
+// @Description Get all webhooks, without their secrets
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Success 200 {array} models.Webhook
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /webhooks [get]
+func (h Handler) GetWebhooks(ctx *gin.Context) {
+	webhooks, err := models.SelectWebhooks(ctx, h.DbConn)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, webhooks)
+}
+
+// @Summary Delete webhook
+// @Description Delete webhook by id, along with its pending deliveries
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /webhooks/{id} [delete]
+func (h Handler) DeleteWebhook(ctx *gin.Context) {
+	var err error
+	var id = ctx.Param("id")
+	var res sql.Result
+
+	res, err = models.DeleteWebhookById(ctx, h.DbConn, id)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	} else if rowsAffected == 0 {
+		respondProblem(ctx, models.NewProblem(http.StatusNotFound, "webhook.not_found", fmt.Sprintf("Webhook with id %s not found", id)))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// @Summary Get webhook deliveries
+// @Description Get the webhook deliveries, dead ones are those that ran out of attempts
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param status query string false "pending, delivered or dead"
+// @Success 200 {array} models.WebhookDelivery
+// @Failure 400 {object} models.Problem
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /webhooks/deliveries [get]
+func (h Handler) GetWebhookDeliveries(ctx *gin.Context) {
+	var err error
+	var deliveries []models.WebhookDelivery
+	var query = struct {
+		Status string `form:"status" binding:"omitempty,oneof=pending delivered dead"`
+	}{}
+
+	err = ctx.ShouldBindQuery(&query)
+	if err != nil {
+		badRequest(ctx, err)
+		return
+	}
+	deliveries, err = models.SelectDeliveries(ctx, h.DbConn, query.Status)
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, deliveries)
+}
+
+// @Summary Replay webhook delivery
+// @Description Send a dead delivery again, with a fresh set of attempts
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path string true "Delivery ID"
+// @Success 200 {object} gin.H
+// @Failure 401 {object} models.Problem
+// @Failure 403 {object} models.Problem
+// @Failure 404 {object} models.Problem
+// @Failure 429 {object} models.Problem
+// @Failure 500 {object} models.Problem
+// @Security BearerAuth
+// @Router /webhooks/deliveries/{id}/replay [post]
+func (h Handler) ReplayWebhookDelivery(ctx *gin.Context) {
+	err := models.ReplayDelivery(ctx, h.DbConn, ctx.Param("id"))
+	if err != nil {
+		respondProblem(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Delivery queued again"})
+}
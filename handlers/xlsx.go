@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const xlsxType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+type xlsxPart struct {
+	name    string
+	content string
+}
+
+// xlsxParts are the parts of a workbook with a single sheet that don't depend
+// on the sheet.
+var xlsxParts = []xlsxPart{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWorkbook lists the sheet, named by its only argument.
+const xlsxWorkbook = `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+// xlsxWriter writes a workbook with a single sheet row by row. The sheet is the
+// last part of the archive, so rows go out as they are written instead of
+// being held until the end.
+type xlsxWriter struct {
+	archive *zip.Writer
+	sheet   io.Writer
+}
+
+func newXlsxWriter(w io.Writer, sheetName string) (*xlsxWriter, error) {
+	var err error
+	var part io.Writer
+	var archive = zip.NewWriter(w)
+
+	parts := append(xlsxParts, xlsxPart{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xmlEscape(sheetName))})
+	for _, p := range parts {
+		part, err = archive.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(part, xml.Header+p.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	part, err = archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(part, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xlsxWriter{archive: archive, sheet: part}, nil
+}
+
+// Write adds a row, numbers become number cells and anything else a text cell.
+func (x *xlsxWriter) Write(cells []any) error {
+	var row strings.Builder
+
+	row.WriteString("<row>")
+	for _, cell := range cells {
+		switch value := cell.(type) {
+		case int:
+			fmt.Fprintf(&row, `<c><v>%d</v></c>`, value)
+		default:
+			fmt.Fprintf(&row, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, xmlEscape(formatCell(cell)))
+		}
+	}
+	row.WriteString("</row>")
+	_, err := io.WriteString(x.sheet, row.String())
+
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	_, err := io.WriteString(x.sheet, `</sheetData></worksheet>`)
+	if err != nil {
+		return err
+	}
+	return x.archive.Close()
+}
+
+func xmlEscape(s string) string {
+	var escaped strings.Builder
+
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
@@ -3,13 +3,23 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "example.com/m/v2/docs"
 	"example.com/m/v2/handlers"
 	"example.com/m/v2/models"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -21,91 +31,261 @@ import (
 // @title           8-Ball Pool Manager
 // @version         1.0
 // @license.name  Apache 2.0
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description Access token from /auth/login, as "Bearer <token>"
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+// @description API key from /api-keys, for services
 func main() {
 	var err error
 	var handler handlers.Handler
-	var router *gin.Engine
 
-	// Dotenv
+	// Logs, at the configured level once the config is loaded
+	slog.SetDefault(handlers.NewLogger(os.Stderr, slog.LevelInfo))
+
+	// Dotenv, optional as the environment may already be set, as in Docker
 	err = godotenv.Load()
-	if err != nil {
-		fmt.Println("Error loading .env file")
-		panic(err)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Could not read .env file", "error", err)
+		os.Exit(2)
 	}
 
-	// Database
-	dbConn := setupDatabaseConnection(os.Getenv("DB_NAME"))
-	defer dbConn.Close()
+	// Config
+	conf, args, err := loadConfig(os.Args[1:], os.Getenv)
+	if len(args) > 0 && args[0] == "config" {
+		// Even an invalid config is printed, to see what is wrong with it
+		err = errors.Join(configCommand(os.Stdout, conf, args[1:]), err)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	} else if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(handlers.NewLogger(os.Stderr, conf.LogLevel))
+	if conf.LogLevel > slog.LevelDebug {
+		// Gin only logs in debug mode, and not as JSON
+		gin.SetMode(gin.ReleaseMode)
+	}
+	scoring, _ := models.ScoringRuleByName(conf.ScoringRule) // validated with the config
 
-	// AWS S3
-	s3Client := setupS3Client(os.Getenv("AWS_REGION"))
+	// Until interrupted, a second interrupt stops right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
-	// Handler
-	handler = handlers.Handler{DbConn: dbConn, S3Client: s3Client, BucketName: os.Getenv("AWS_BUCKET_NAME"), Region: os.Getenv("AWS_REGION")}
-	err = handler.CreateBucket(context.TODO())
+	// Commands
+	if len(args) > 0 {
+		dbConn, err := setupDatabaseConnection(conf.DbName)
+		if err == nil {
+			err = runCommand(ctx, dbConn, args)
+			dbConn.Close()
+		}
+		if err != nil {
+			slog.Error("Command failed", "command", args[0], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Database, migrated by the server as it may not be reachable yet
+	dbConn, err := openDatabase(conf.DbName)
 	if err != nil {
-		fmt.Println("Error creating bucket")
-		panic(err)
+		slog.Error("Could not open database", "error", err)
+		os.Exit(1)
 	}
 
-	// Router
-	router = setupRouter(handler)
-	router.Run() // listen and serve on 0.0.0.0:8080
-}
+	// AWS S3
+	s3Client, err := setupS3Client(conf)
+	if err != nil {
+		slog.Error("Could not load AWS config", "error", err)
+		os.Exit(1)
+	}
 
-func setupDatabaseConnection(dbName string) *sql.DB {
-	var dbConn *sql.DB
-	var err error
+	// Handler
+	handler = handlers.Handler{DbConn: dbConn, S3Client: s3Client, BucketName: conf.AwsBucketName, Region: conf.AwsRegion, Scoring: scoring, Hub: handlers.NewHub(), JwtSecret: []byte(conf.JwtSecret), RateLimitStore: handlers.NewMemoryRateLimitStore(), RateLimits: conf.RateLimits, TrustedProxies: conf.TrustedProxies}
 
-	dbConn, err = sql.Open("sqlite", dbName)
+	// Serve
+	err = serve(ctx, handler, conf, dbConn)
 	if err != nil {
-		fmt.Println("Could not open database connection")
-		panic(err)
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
 	}
+}
 
-	_, err = models.CreatePlayersTable(dbConn)
+func setupDatabaseConnection(dbName string) (*sql.DB, error) {
+	dbConn, err := openDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+	err = models.Migrate(dbConn)
 	if err != nil {
-		fmt.Println("Could not create players table")
-		panic(err)
+		dbConn.Close()
+		return nil, fmt.Errorf("could not migrate database: %w", err)
+	}
+
+	return dbConn, nil
+}
+
+// openDatabase opens the database without migrating it, the server migrates it
+// once it can.
+func openDatabase(dbName string) (*sql.DB, error) {
+	// Writes wait a while for the reads under way rather than fail at once
+	separator := "?"
+	if strings.Contains(dbName, "?") {
+		separator = "&"
 	}
-	_, err = models.CreateMatchesTable(dbConn)
+	dbConn, err := sql.Open("sqlite", dbName+separator+"_pragma=busy_timeout(5000)")
 	if err != nil {
-		fmt.Println("Could not create matches table")
-		panic(err)
+		return nil, fmt.Errorf("could not open database connection: %w", err)
 	}
 
-	return dbConn
+	return dbConn, nil
 }
 
 func setupRouter(h handlers.Handler) *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	// Handlers pass their ctx on to the models, it carries the request context
+	router.ContextWithFallback = true
+	router.SetTrustedProxies(h.TrustedProxies) // validated with the config
+	router.Use(handlers.AssignRequestId, handlers.LogRequests, gin.CustomRecoveryWithWriter(io.Discard, handlers.Recover), handlers.ObserveRequests)
+	signIn := h.RateLimit(handlers.RateLimitAuth)
+	read := h.RateLimit(handlers.RateLimitRead)
+	write := h.RateLimit(handlers.RateLimitWrite)
+	// Every API request is limited by IP first, whatever credentials it has
+	api := router.Group("", h.RateLimit(handlers.RateLimitIp))
 
-	router.POST("/players", h.PostPlayer)
-	router.GET("/players", h.GetPlayers)
-	router.GET("/players/:id", h.GetPlayer)
-	router.PUT("/players/:id", h.PutPlayer)
-	router.DELETE("/players/:id", h.DeletePlayer)
+	api.POST("/auth/register", signIn, h.PostRegister)
+	api.POST("/auth/login", signIn, h.PostLogin)
+	api.POST("/auth/refresh", signIn, h.PostRefresh)
 
-	router.POST("/matches", h.PostMatch)
-	router.GET("/matches", h.GetMatches)
-	router.GET("/matches/:id", h.GetMatch)
-	router.PUT("/matches/:id", h.PutMatch)
-	router.DELETE("/matches/:id", h.DeleteMatch)
+	api.GET("/users", h.Authenticate, read, h.Require(models.PermissionUsersManage), h.GetUsers)
+	api.PUT("/users/:id", h.Authenticate, write, h.Require(models.PermissionUsersManage), h.PutUser)
+
+	api.POST("/api-keys", h.Authenticate, write, h.Require(models.PermissionApiKeysManage), h.PostApiKey)
+	api.GET("/api-keys", h.Authenticate, read, h.Require(models.PermissionApiKeysManage), h.GetApiKeys)
+	api.POST("/api-keys/:id/rotate", h.Authenticate, write, h.Require(models.PermissionApiKeysManage), h.RotateApiKey)
+	api.DELETE("/api-keys/:id", h.Authenticate, write, h.Require(models.PermissionApiKeysManage), h.RevokeApiKey)
+
+	api.POST("/players", h.Authenticate, write, h.Require(models.PermissionPlayersCreate), h.Idempotent, h.PostPlayer)
+	api.GET("/players", h.Identify(models.PermissionPlayersRead), read, h.GetPlayers)
+	api.GET("/players/:id", h.Identify(models.PermissionPlayersRead), read, h.GetPlayer)
+	api.PUT("/players/:id", h.Authenticate, write, h.Require(models.PermissionPlayersUpdate, models.PermissionProfileUpdate), h.PutPlayer)
+	api.PATCH("/players/:id", h.Authenticate, write, h.Require(models.PermissionPlayersUpdate, models.PermissionProfileUpdate), h.PatchPlayer)
+	api.DELETE("/players/:id", h.Authenticate, write, h.Require(models.PermissionPlayersDelete), h.DeletePlayer)
+	api.POST("/players/:id/restore", h.Authenticate, write, h.Require(models.PermissionPlayersDelete), h.RestorePlayer)
+	api.POST("/players/:id/claim", h.Authenticate, write, h.PostPlayerClaim)
+	api.POST("/players/:id/picture", h.Authenticate, write, h.PostProfilePictureUrl)
+
+	api.GET("/claims", h.Authenticate, read, h.Require(models.PermissionClaimsDecide), h.GetPlayerClaims)
+	api.POST("/claims/:id/approve", h.Authenticate, write, h.Require(models.PermissionClaimsDecide), h.ApprovePlayerClaim)
+	api.POST("/claims/:id/reject", h.Authenticate, write, h.Require(models.PermissionClaimsDecide), h.RejectPlayerClaim)
+
+	api.POST("/matches", h.Authenticate, write, h.Require(models.PermissionMatchesCreate), h.Idempotent, h.PostMatch)
+	api.GET("/matches", h.Identify(models.PermissionMatchesRead), read, h.GetMatches)
+	api.GET("/matches/:id", h.Identify(models.PermissionMatchesRead), read, h.GetMatch)
+	api.PUT("/matches/:id", h.Authenticate, write, h.Require(models.PermissionMatchesUpdate, models.PermissionResultsWrite), h.PutMatch)
+	api.PATCH("/matches/:id", h.Authenticate, write, h.Require(models.PermissionMatchesUpdate, models.PermissionResultsWrite), h.PatchMatch)
+	api.DELETE("/matches/:id", h.Authenticate, write, h.Require(models.PermissionMatchesDelete), h.DeleteMatch)
+	api.POST("/matches/:id/restore", h.Authenticate, write, h.Require(models.PermissionMatchesDelete), h.RestoreMatch)
+	api.GET("/matches/:id/events", h.Identify(models.PermissionMatchesRead), read, h.GetMatchEvents)
+	api.GET("/matches/:id/ws", h.Identify(models.PermissionMatchesRead), read, h.GetMatchEventsWebSocket)
+
+	api.POST("/import/players", h.Authenticate, write, h.Require(models.PermissionPlayersCreate), h.ImportPlayers)
+	api.POST("/import/matches", h.Authenticate, write, h.Require(models.PermissionMatchesCreate), h.ImportMatches)
+
+	api.GET("/export/players", h.Identify(models.PermissionPlayersRead), read, h.ExportPlayers)
+	api.GET("/export/matches", h.Identify(models.PermissionMatchesRead), read, h.ExportMatches)
+	api.GET("/export/standings", h.Identify(models.PermissionPlayersRead), read, h.ExportStandings)
+
+	api.GET("/standings", h.Identify(models.PermissionPlayersRead), read, h.GetStandings)
+
+	api.GET("/audit", h.Authenticate, read, h.Require(models.PermissionAuditRead), h.GetAuditEvents)
+
+	api.POST("/graphql", h.Identify(models.PermissionPlayersRead, models.PermissionMatchesRead), read, h.PostGraphql)
+
+	api.POST("/webhooks", h.Authenticate, write, h.Require(models.PermissionWebhooksManage), h.PostWebhook)
+	api.GET("/webhooks", h.Authenticate, read, h.Require(models.PermissionWebhooksManage), h.GetWebhooks)
+	api.DELETE("/webhooks/:id", h.Authenticate, write, h.Require(models.PermissionWebhooksManage), h.DeleteWebhook)
+	api.GET("/webhooks/deliveries", h.Authenticate, read, h.Require(models.PermissionWebhooksManage), h.GetWebhookDeliveries)
+	api.POST("/webhooks/deliveries/:id/replay", h.Authenticate, write, h.Require(models.PermissionWebhooksManage), h.ReplayWebhookDelivery)
+
+	router.GET("/healthz", h.GetHealthz)
+	router.GET("/readyz", h.GetReadyz)
+	router.GET("/metrics", h.GetMetrics)
 
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	return router
 }
 
-func setupS3Client(region string) *s3.Client {
+func setupS3Client(conf Config) (*s3.Client, error) {
 	ctx := context.TODO()
 
-	// Load AWS config
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	// Load AWS config, with the credentials of the config if any
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(conf.AwsRegion)}
+	if conf.AwsAccessKeyId != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(conf.AwsAccessKeyId, conf.AwsSecretAccessKey, "")))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
 	if err != nil {
-		fmt.Println("Failed to load AWS config")
-		panic(err)
+		return nil, err
+	}
+	// Frozen into an http.Client, as the buildable one can't close its
+	// connections on shutdown. It keeps what the config set, a CA bundle say.
+	if client, ok := cfg.HTTPClient.(*awshttp.BuildableClient); ok {
+		cfg.HTTPClient = client.Freeze()
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, handlers.ObserveStorage)
+	}), nil
+}
+
+// purgeDeletedPeriodically purges every hour until ctx is done. A purge
+// started runs to its end.
+func purgeDeletedPeriodically(ctx context.Context, h handlers.Handler, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		work := context.WithoutCancel(ctx)
+		err := h.PurgeDeleted(work, retention)
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not purge deleted rows", "error", err)
+		}
+		_, err = models.PurgeIdempotencyKeysBefore(work, h.DbConn, time.Now().Add(-handlers.IdempotencyKeyRetention))
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not purge idempotency keys", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	return s3.NewFromConfig(cfg)
+// deliverWebhooksPeriodically delivers the pending webhooks every 5 seconds
+// until ctx is done. Deliveries started run to their end.
+func deliverWebhooksPeriodically(ctx context.Context, h handlers.Handler) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := h.DeliverWebhooks(context.WithoutCancel(ctx))
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not deliver webhooks", "error", err)
+		}
+	}
 }
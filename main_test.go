@@ -1,74 +1,370 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"example.com/m/v2/handlers"
 	"example.com/m/v2/models"
+	"example.com/m/v2/poolpb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var dbConn *sql.DB
 var handler handlers.Handler
 var router *gin.Engine
+var token string
 
-func setupTestingSuit() (*sql.DB, handlers.Handler, *gin.Engine) {
-	var err error
-	dbConn := setupDatabaseConnection("test" + time.Now().Format("20060102_150405") + ".db")
+const testUserEmail = "tester@example.com"
+
+func setupTestingSuit(t *testing.T) (*sql.DB, handlers.Handler, *gin.Engine) {
+	dbConn, err := setupDatabaseConnection(t.TempDir() + "/test.db")
+	if err != nil {
+		panic(err)
+	}
 
 	err = godotenv.Load()
 	if err != nil {
-		fmt.Println("Error loading .env file")
+		fmt.Println("No .env file, using the environment")
+	}
+	// Only the AWS settings are needed, the rest is set for the tests
+	conf, _, _ := loadConfig(nil, os.Getenv)
+	s3Client, err := setupS3Client(conf)
+	if err != nil {
 		panic(err)
 	}
 
-	handler := handlers.Handler{DbConn: dbConn, S3Client: setupS3Client(os.Getenv("AWS_REGION")), BucketName: fmt.Sprintf("test-bucket-%d", time.Now().UnixNano()), Region: os.Getenv("AWS_REGION")}
+	handler := handlers.Handler{DbConn: dbConn, S3Client: s3Client, BucketName: fmt.Sprintf("test-bucket-%d", time.Now().UnixNano()), Region: conf.AwsRegion, Hub: handlers.NewHub(), JwtSecret: []byte("test-secret-long-enough-for-hs256"), RateLimitStore: handlers.NewMemoryRateLimitStore(), AllowPrivateWebhooks: true}
 	router := setupRouter(handler)
+	token = signInTestUser(handler)
 
 	err = handler.CreateBucket(context.TODO())
 
 	return dbConn, handler, router
 }
 
+// signInTestUser creates the admin the tests act as and mints its access
+// token locally.
+func signInTestUser(h handlers.Handler) string {
+	return signInAs(h, testUserEmail, models.RoleAdmin, nil)
+}
+
+// signInAs creates a user with role and mints its access token locally.
+func signInAs(h handlers.Handler, email string, role string, playerId *int) string {
+	user, err := models.NewUser(models.Credentials{Email: email, Password: "test-password"})
+	if err != nil {
+		panic(err)
+	}
+	user.Role = role
+	user.PlayerId = playerId
+	_, err = user.Create(context.Background(), h.DbConn)
+	if err != nil {
+		panic(err)
+	}
+	token, err := handlers.NewAccessToken(h.JwtSecret, user)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// authorize authenticates req as the test user.
+func authorize(req *http.Request) {
+	authorizeAs(req, token)
+}
+
+func authorizeAs(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
 func TestPlayers(t *testing.T) {
-	dbConn, handler, router = setupTestingSuit()
+	dbConn, handler, router = setupTestingSuit(t)
 	defer dbConn.Close()
 
+	t.Run("Auth", testAuth)
 	t.Run("PostPlayer", testPostPlayer)
 	t.Run("GetPlayers", testGetPlayers)
 	t.Run("GetPlayer", testGetPlayer)
 	t.Run("PutPlayer", testPutPlayer)
+	t.Run("PatchPlayer", testPatchPlayer)
+	t.Run("ConditionalPlayer", testConditionalPlayer)
 	t.Run("DeletePlayer", testDeletePlayer)
+	t.Run("RestorePlayer", testRestorePlayer)
+	t.Run("IdempotentPostPlayer", testIdempotentPostPlayer)
+	t.Run("Webhooks", testWebhooks)
+	t.Run("Claims", testClaims)
+	t.Run("RateLimits", testRateLimits)
+	t.Run("Health", testHealth)
+	t.Run("RequestId", testRequestId)
 
 	err := handler.DeleteBucket(context.TODO())
 	assert.Nil(t, err)
 }
 
 func TestMatches(t *testing.T) {
-	dbConn, handler, router = setupTestingSuit()
+	dbConn, handler, router = setupTestingSuit(t)
 	defer dbConn.Close()
 
 	t.Run("PostMatch", testPostMatch)
 	t.Run("GetMatches", testGetMatches)
+	t.Run("PagePlayers", testPagePlayers)
 	t.Run("GetMatch", testGetMatch)
 	t.Run("PutMatch", testPutMatch)
+	t.Run("GetStandings", testGetStandings)
 	t.Run("DeleteMatch", testDeleteMatch)
+	t.Run("RestoreMatch", testRestoreMatch)
+	t.Run("GetAuditEvents", testGetAuditEvents)
+	t.Run("Import", testImport)
+	t.Run("Export", testExport)
+	t.Run("FollowMatch", testFollowMatch)
+	t.Run("Graphql", testGraphql)
+	t.Run("Roles", testRoles)
+	t.Run("Grpc", testGrpc)
+	t.Run("ApiKeys", testApiKeys)
+	t.Run("Metrics", testMetrics)
 
 	err := handler.DeleteBucket(context.TODO())
 	assert.Nil(t, err)
 }
 
+func TestConfig(t *testing.T) {
+	t.Run("Precedence", testConfigPrecedence)
+	t.Run("Errors", testConfigErrors)
+	t.Run("Print", testConfigPrint)
+}
+
+func TestServe(t *testing.T) {
+	// A server of its own, as serve closes its database
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	conf := defaultConfig()
+	conf.ListenAddr = addr
+	conf.GrpcPort = 0
+	conf.ShutdownTimeout = 5 * time.Second
+	db, err := setupDatabaseConnection(t.TempDir() + "/serve.db")
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := handlers.Handler{DbConn: db, S3Client: s3.New(s3.Options{Region: "us-east-1"}), Hub: handlers.NewHub(), JwtSecret: []byte("test-secret-long-enough-for-hs256")}
+	admin := signInTestUser(h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, h, conf, db)
+	}()
+	baseUrl := "http://" + addr
+	assert.Eventually(t, func() bool {
+		res, err := http.Get(baseUrl + "/players")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Follow a match, its stream would never end on its own
+	models.Player{Name: "Serve 1"}.Create(context.Background(), db)
+	models.Player{Name: "Serve 2"}.Create(context.Background(), db)
+	req, _ := http.NewRequest("POST", baseUrl+"/matches", strings.NewReader(`{"player1id": 1, "player2id": 2, "startTime": "2032-01-01T18:00:00Z", "tableNumber": 1}`))
+	authorizeAs(req, admin)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	res, err = http.Get(baseUrl + "/matches/1/events")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// Shutting down ends the stream, then closes the database
+	cancel()
+	select {
+	case err = <-served:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not return")
+	}
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "event: MatchScheduled")
+	assert.Error(t, db.Ping())
+	_, err = http.Get(baseUrl + "/players")
+	assert.Error(t, err)
+}
+
+// testEnv is an environment of only values.
+func testEnv(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+var validEnv = map[string]string{
+	"AWS_BUCKET_NAME": "bucket",
+	"AWS_REGION":      "eu-west-1",
+	"JWT_SECRET":      "test-secret-long-enough-for-hs256",
+	"DB_NAME":         "from-env.db",
+	"GRPC_PORT":       "9191",
+}
+
+func testConfigPrecedence(t *testing.T) {
+	file := t.TempDir() + "/pool.yaml"
+	os.WriteFile(file, []byte("db_name: from-file.db\npurge_retention: 48h\ntrusted_proxies: [10.0.0.1, 10.0.0.2]\n"), 0o600)
+
+	// Defaults, then the environment, then the file, then flags
+	conf, args, err := loadConfig([]string{"-config", file, "-db-name", "from-flag.db", "replay", "-scoring", "flat"}, testEnv(validEnv))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "from-flag.db", conf.DbName)
+	assert.Equal(t, 48*time.Hour, conf.PurgeRetention)
+	assert.Equal(t, 9191, conf.GrpcPort)
+	assert.Equal(t, "default", conf.ScoringRule)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, conf.TrustedProxies)
+	assert.Equal(t, handlers.DefaultRateLimits, conf.RateLimits)
+	assert.Equal(t, []string{"replay", "-scoring", "flat"}, args)
+
+	file = t.TempDir() + "/pool.toml"
+	os.WriteFile(file, []byte("rate_limit_write = \"5/1s\"\n"), 0o600)
+	conf, _, err = loadConfig(nil, testEnv(map[string]string{"CONFIG_FILE": file, "AWS_BUCKET_NAME": "bucket", "AWS_REGION": "eu-west-1", "JWT_SECRET": validEnv["JWT_SECRET"], "LOG_LEVEL": "warn"}))
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, conf.LogLevel)
+	assert.Equal(t, handlers.Limit{Requests: 5, Period: time.Second}, conf.RateLimits[handlers.RateLimitWrite])
+	assert.Equal(t, "pool.db", conf.DbName)
+}
+
+func testConfigErrors(t *testing.T) {
+	file := t.TempDir() + "/pool.yaml"
+	os.WriteFile(file, []byte("grpc_prot: 9090\n"), 0o600)
+
+	// Everything wrong is reported at once
+	_, _, err := loadConfig([]string{"-config", file, "-rate-limit-read", "lots"}, testEnv(map[string]string{"JWT_SECRET": "short", "SCORING_RULE": "golf", "TLS_CERT_FILE": "cert.pem", "LISTEN_ADDR": "8080"}))
+	var configErr ConfigError
+	if !assert.ErrorAs(t, err, &configErr) {
+		return
+	}
+	assert.Equal(t, ConfigError{
+		"grpc_prot from file " + file + ": unknown setting",
+		`rate_limit_read from flag -rate-limit-read: rate limit "lots" is not requests/period`,
+		"aws_bucket_name (AWS_BUCKET_NAME or -aws-bucket-name): required",
+		"aws_region (AWS_REGION or -aws-region): required",
+		"jwt_secret (JWT_SECRET or -jwt-secret): must be at least 32 characters",
+		"listen_addr (LISTEN_ADDR or -listen-addr): must be host:port",
+		"tls_cert_file and tls_key_file: set both or neither",
+		`scoring_rule (SCORING_RULE or -scoring-rule): unknown scoring rule "golf"`,
+	}, configErr)
+}
+
+func testConfigPrint(t *testing.T) {
+	var out strings.Builder
+
+	conf, _, err := loadConfig([]string{"-grpc-port", "9292"}, testEnv(validEnv))
+	assert.NoError(t, err)
+	err = configCommand(&out, conf, []string{"print"})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `jwt_secret: "<redacted>" # env JWT_SECRET`)
+	assert.NotContains(t, out.String(), validEnv["JWT_SECRET"])
+	assert.Contains(t, out.String(), `grpc_port: "9292" # flag -grpc-port`)
+	assert.Contains(t, out.String(), `purge_retention: "720h0m0s" # default`)
+}
+
+func testAuth(t *testing.T) {
+	// Changes need a signed in user
+	req, _ := http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestAnonymousPlayer"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestAnonymousPlayer"}`))
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	// Register, sign in and refresh
+	req, _ = http.NewRequest("POST", "/auth/register", strings.NewReader(`{"email": "TestAuth@example.com", "password": "correct horse"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/register", strings.NewReader(`{"email": "testauth@example.com", "password": "correct horse"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/login", strings.NewReader(`{"email": "testauth@example.com", "password": "wrong horse"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/login", strings.NewReader(`{"email": "testauth@example.com", "password": "correct horse"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var tokens handlers.Tokens
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.Equal(t, "Bearer", tokens.TokenType)
+
+	// A refresh token doesn't authenticate requests, it only gets new tokens
+	req, _ = http.NewRequest("DELETE", "/players/999", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.RefreshToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refreshToken": "`+tokens.RefreshToken+`"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refreshToken": "`+tokens.AccessToken+`"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
 func testPostPlayer(t *testing.T) {
 	// Create an example user for testing
 	examplePlayer := models.Player{
@@ -76,10 +372,13 @@ func testPostPlayer(t *testing.T) {
 	}
 	playerJson, _ := json.Marshal(examplePlayer)
 	req, _ := http.NewRequest("POST", "/players", strings.NewReader(string(playerJson)))
+	authorize(req)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
+	// Only the owner of the player gets the upload URL of its picture
+	assert.NotContains(t, w.Body.String(), "url")
 }
 
 func testGetPlayers(t *testing.T) {
@@ -107,6 +406,16 @@ func testGetPlayers(t *testing.T) {
 	json.Unmarshal(w.Body.Bytes(), &players)
 
 	assert.Greater(t, len(players), 0)
+
+	// A row that can't be read fails the list rather than being left out
+	_, err := dbConn.Exec("UPDATE players SET ranking = 'first' WHERE id = ?", players[0].Id)
+	assert.Nil(t, err)
+	req, _ = http.NewRequest("GET", "/players", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+	_, err = dbConn.Exec("UPDATE players SET ranking = ? WHERE id = ?", players[0].Ranking, players[0].Id)
+	assert.Nil(t, err)
 }
 
 func testGetPlayer(t *testing.T) {
@@ -131,6 +440,7 @@ func testPutPlayer(t *testing.T) {
 	}
 	playerJson, _ := json.Marshal(examplePlayer)
 	req, _ := http.NewRequest("PUT", "/players/1", strings.NewReader(string(playerJson)))
+	authorize(req)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
@@ -145,150 +455,1783 @@ func testPutPlayer(t *testing.T) {
 	var player models.Player
 	json.Unmarshal(w.Body.Bytes(), &player)
 	assert.Equal(t, examplePlayer.Name, player.Name)
-}
 
-func testDeletePlayer(t *testing.T) {
-	// Delete the created user
-	req, _ := http.NewRequest("DELETE", "/players/1", nil)
-	w := httptest.NewRecorder()
+	// Ranking and points only come from the match history
+	req, _ = http.NewRequest("PUT", "/players/1", strings.NewReader(`{"name": "TestPutPlayer", "ranking": 99, "points": 99}`))
+	authorize(req)
+	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
-	// Check if the user was deleted
 	req, _ = http.NewRequest("GET", "/players/1", nil)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-
-	assert.Equal(t, 404, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &player)
+	assert.Equal(t, 0, player.Ranking)
+	assert.Equal(t, 0, player.Points)
 }
 
-func testPostMatch(t *testing.T) {
-	// Create two players for testing
-	examplePlayer1 := models.Player{
-		Name: "TestPostMatch1",
-	}
-	playerJson, _ := json.Marshal(examplePlayer1)
-	req, _ := http.NewRequest("POST", "/players", strings.NewReader(string(playerJson)))
+func testPatchPlayer(t *testing.T) {
+	// Set a field with a merge patch
+	req, _ := http.NewRequest("PATCH", "/players/1", strings.NewReader(`{"preferredCue": "Predator"}`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	examplePlayer2 := models.Player{
-		Name: "TestPostMatch2",
-	}
-	playerJson, _ = json.Marshal(examplePlayer2)
-	req, _ = http.NewRequest("POST", "/players", strings.NewReader(string(playerJson)))
+
+	assert.Equal(t, 200, w.Code)
+
+	var player models.Player
+	json.Unmarshal(w.Body.Bytes(), &player)
+	assert.Equal(t, "Predator", player.PreferredCue)
+	assert.Equal(t, "TestPutPlayer", player.Name)
+
+	// Clear it again with null
+	req, _ = http.NewRequest("PATCH", "/players/1", strings.NewReader(`{"preferredCue": null}`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	// Create an example match for testing
-	exampleMatch := models.Match{
-		Player1id: 1,
-		Player2id: 2,
-		StartTime: time.Now(),
-	}
-	matchJson, _ := json.Marshal(exampleMatch)
-	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(string(matchJson)))
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/players/1", nil)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	fmt.Println(w.Body.String())
-	assert.Equal(t, 200, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &player)
+	assert.Equal(t, "", player.PreferredCue)
 
-	// Intent to create a match with the same players in the same time
-	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(string(matchJson)))
+	// The patched player must still be valid
+	req, _ = http.NewRequest("PATCH", "/players/1", strings.NewReader(`{"name": null}`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	assert.Equal(t, 409, w.Code)
+	assert.Equal(t, 400, w.Code)
+
+	// Replace a field with a JSON patch
+	req, _ = http.NewRequest("PATCH", "/players/1", strings.NewReader(`[{"op": "replace", "path": "/name", "value": "TestPatchPlayer"}]`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/json-patch+json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	json.Unmarshal(w.Body.Bytes(), &player)
+	assert.Equal(t, "TestPatchPlayer", player.Name)
 }
 
-func testGetMatches(t *testing.T) {
-	// Get all matches
-	req, _ := http.NewRequest("GET", "/matches", nil)
+func testConditionalPlayer(t *testing.T) {
+	// The player comes with its ETag
+	req, _ := http.NewRequest("GET", "/players/1", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
 
-	// Eval if the created match is in the list
-	var matches []models.Match
-	json.Unmarshal(w.Body.Bytes(), &matches)
+	// A client with the current copy gets no body
+	req, _ = http.NewRequest("GET", "/players/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 
-	assert.Greater(t, len(matches), 0)
-	assert.Equal(t, 1, matches[0].Player1id)
+	assert.Equal(t, 304, w.Code)
 
-	// Get the match by status
-	req, _ = http.NewRequest("GET", "/matches?status=upcoming", nil)
+	// Updating the current version works and changes the ETag
+	req, _ = http.NewRequest("PATCH", "/players/1", strings.NewReader(`{"preferredCue": "Mezz"}`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", etag)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
 
-	json.Unmarshal(w.Body.Bytes(), &matches)
+	// Updating or deleting the old version is rejected
+	req, _ = http.NewRequest("PUT", "/players/1", strings.NewReader(`{"name": "TestConditionalPlayer"}`))
+	authorize(req)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 
-	assert.Greater(t, len(matches), 0)
+	assert.Equal(t, 412, w.Code)
+
+	req, _ = http.NewRequest("DELETE", "/players/1", nil)
+	authorize(req)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 412, w.Code)
 }
 
-func testGetMatch(t *testing.T) {
-	// Get the created match
-	req, _ := http.NewRequest("GET", "/matches/1", nil)
+func testDeletePlayer(t *testing.T) {
+	// Delete the created user
+	req, _ := http.NewRequest("DELETE", "/players/1", nil)
+	authorize(req)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-
 	assert.Equal(t, 200, w.Code)
 
-	// Eval if the match is the created match
-	var match models.Match
-	json.Unmarshal(w.Body.Bytes(), &match)
+	// Check if the user was deleted
+	req, _ = http.NewRequest("GET", "/players/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 
-	assert.Equal(t, 1, match.Player1id)
+	assert.Equal(t, 404, w.Code)
 }
 
-func testPutMatch(t *testing.T) {
-	// Update the created match
-	exampleMatch := models.Match{
-		Player1id: 1,
-		Player2id: 2,
-		StartTime: time.Now(),
-		EndTime:   time.Now(),
-		WinnerId:  2,
-	}
-	matchJson, _ := json.Marshal(exampleMatch)
-	req, _ := http.NewRequest("PUT", "/matches/1", strings.NewReader(string(matchJson)))
+func testRestorePlayer(t *testing.T) {
+	// The deleted user is hidden from the list unless asked for
+	req, _ := http.NewRequest("GET", "/players", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	assert.Equal(t, 200, w.Code)
 
-	// Get the updated match
-	req, _ = http.NewRequest("GET", "/matches/1", nil)
+	var players []models.Player
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 0, len(players))
+
+	req, _ = http.NewRequest("GET", "/players?includeDeleted=true", nil)
+	authorize(req)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	// Check if the match was updated
-	var match models.Match
-	json.Unmarshal(w.Body.Bytes(), &match)
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 1, len(players))
+	assert.NotNil(t, players[0].DeletedAt)
 
-	assert.Equal(t, exampleMatch.EndTime.Format("2006-01-02 15:04:05"), match.EndTime.Format("2006-01-02 15:04:05"))
+	// Only admins see deleted players
+	req, _ = http.NewRequest("GET", "/players?includeDeleted=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
 
-	// Assert that the winner got the points
-	req, _ = http.NewRequest("GET", "/players/2", nil)
+	req, _ = http.NewRequest("GET", "/export/players?includeDeleted=true", nil)
+	authorizeAs(req, signInAs(handler, "deleted-organiser@example.com", models.RoleOrganiser, nil))
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	var player models.Player
-	json.Unmarshal(w.Body.Bytes(), &player)
+	assert.Equal(t, 403, w.Code)
 
-	assert.Equal(t, 1, player.Points)
+	// Restore the deleted user
+	req, _ = http.NewRequest("POST", "/players/1/restore", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/players/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// A user that is not deleted can't be restored
+	req, _ = http.NewRequest("POST", "/players/1/restore", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
 }
-func testDeleteMatch(t *testing.T) {
-	// Delete the created match
-	req, _ := http.NewRequest("DELETE", "/matches/1", nil)
+
+func testIdempotentPostPlayer(t *testing.T) {
+	// Create a user with an idempotency key
+	req, _ := http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestIdempotentPlayer"}`))
+	authorize(req)
+	req.Header.Set("Idempotency-Key", "create-test-idempotent-player")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	first := w.Body.String()
 
+	// A retry gets the first response again without creating another user
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestIdempotentPlayer"}`))
+	authorize(req)
+	req.Header.Set("Idempotency-Key", "create-test-idempotent-player")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, first, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
 
-	// Check if the match was deleted
-	req, _ = http.NewRequest("GET", "/matches/1", nil)
+	req, _ = http.NewRequest("GET", "/players?name=TestIdempotentPlayer", nil)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	assert.Equal(t, 404, w.Code)
+	var players []models.Player
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 1, len(players))
+
+	// The same key can't be used for a different user
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestOtherPlayer"}`))
+	authorize(req)
+	req.Header.Set("Idempotency-Key", "create-test-idempotent-player")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+
+	// Another user with the same key and body gets a player of their own
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestIdempotentPlayer"}`))
+	authorizeAs(req, signInAs(handler, "idempotent-organiser@example.com", models.RoleOrganiser, nil))
+	req.Header.Set("Idempotency-Key", "create-test-idempotent-player")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	req, _ = http.NewRequest("GET", "/players?name=TestIdempotentPlayer", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 2, len(players))
+
+	// A handler that panics releases its key, so the request can be retried
+	panicking := gin.New()
+	panicking.Use(gin.CustomRecoveryWithWriter(io.Discard, handlers.Recover))
+	panicking.POST("/panic", handler.Idempotent, func(*gin.Context) { panic("test panic") })
+	req, _ = http.NewRequest("POST", "/panic", strings.NewReader(`{}`))
+	req.Header.Set("Idempotency-Key", "test-panic")
+	w = httptest.NewRecorder()
+	panicking.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+
+	_, reserved, err := models.ReserveIdempotencyKey(context.Background(), dbConn, "test-panic", "", "POST /panic", "", time.Now().Add(-handlers.IdempotencyKeyRetention))
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+
+	// Keys are free again once they have expired, even before they are purged
+	_, reserved, err = models.ReserveIdempotencyKey(context.Background(), dbConn, "test-panic", "", "POST /panic", "", time.Now().Add(-handlers.IdempotencyKeyRetention))
+	assert.Nil(t, err)
+	assert.False(t, reserved)
+	_, reserved, err = models.ReserveIdempotencyKey(context.Background(), dbConn, "test-panic", "", "POST /panic", "", time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+}
+
+func testWebhooks(t *testing.T) {
+	// A subscriber that accepts the first delivery and fails the others
+	var mu sync.Mutex
+	var received [][]byte
+	var headers []http.Header
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, body)
+		headers = append(headers, r.Header)
+		if len(received) > 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer subscriber.Close()
+
+	// Webhooks can't reach the services next to the API
+	strict := handler
+	strict.AllowPrivateWebhooks = false
+	strictRouter := setupRouter(strict)
+	for _, url := range []string{subscriber.URL, "http://localhost/hook", "http://169.254.169.254/latest", "http://10.0.0.1/hook", "http://[::1]/hook"} {
+		req, _ := http.NewRequest("POST", "/webhooks", strings.NewReader(`{"url": "`+url+`", "events": ["player.created"]}`))
+		authorize(req)
+		w := httptest.NewRecorder()
+		strictRouter.ServeHTTP(w, req)
+		assert.Equal(t, 400, w.Code, url)
+	}
+
+	// Subscribe to new users
+	req, _ := http.NewRequest("POST", "/webhooks", strings.NewReader(`{"url": "`+subscriber.URL+`", "events": ["player.created"], "secret": "test-secret"}`))
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// Create a user, the subscriber gets a signed delivery
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestWebhookPlayer"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	err := handler.DeliverWebhooks(context.TODO())
+	assert.Nil(t, err)
+	if assert.Len(t, received, 1) {
+		assert.Contains(t, string(received[0]), "TestWebhookPlayer")
+		assert.Equal(t, "player.created", headers[0].Get("X-Webhook-Event"))
+		mac := hmac.New(sha256.New, []byte("test-secret"))
+		mac.Write([]byte(headers[0].Get("X-Webhook-Timestamp") + "."))
+		mac.Write(received[0])
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers[0].Get("X-Webhook-Signature"))
+	}
+
+	// A failed delivery stays pending for a later attempt
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestWebhookPlayer2"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	err = handler.DeliverWebhooks(context.TODO())
+	assert.Nil(t, err)
+
+	req, _ = http.NewRequest("GET", "/webhooks/deliveries?status=pending", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var deliveries []models.WebhookDelivery
+	json.Unmarshal(w.Body.Bytes(), &deliveries)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, 1, deliveries[0].Attempts)
+		assert.Contains(t, deliveries[0].LastError, "500")
+	}
+
+	// Only dead deliveries can be replayed
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/webhooks/deliveries/%d/replay", deliveries[0].Id), nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	// A slow subscriber doesn't hold back a fast one
+	fastDone := make(chan struct{})
+	var slowWaited atomic.Bool
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastDone)
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastDone:
+			slowWaited.Store(true)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	var webhookIds []int
+	for _, url := range []string{slow.URL, fast.URL} {
+		req, _ = http.NewRequest("POST", "/webhooks", strings.NewReader(`{"url": "`+url+`", "events": ["match.scheduled"]}`))
+		authorize(req)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var webhook models.Webhook
+		json.Unmarshal(w.Body.Bytes(), &webhook)
+		webhookIds = append(webhookIds, webhook.Id)
+	}
+
+	// A match refused for its table leaves no event behind, as events are
+	// saved with the change they are about
+	body := `{"player1id": 1, "player2id": 2, "startTime": "2036-01-01T18:00:00Z", "tableNumber": 21}`
+	for _, code := range []int{200, 409} {
+		req, _ = http.NewRequest("POST", "/matches", strings.NewReader(body))
+		authorize(req)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code)
+	}
+	err = handler.DeliverWebhooks(context.TODO())
+	assert.Nil(t, err)
+	assert.True(t, slowWaited.Load())
+
+	req, _ = http.NewRequest("GET", "/webhooks/deliveries?status=delivered", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &deliveries)
+	scheduled := 0
+	for _, delivery := range deliveries {
+		if delivery.Event == models.WebhookMatchScheduled {
+			scheduled++
+		}
+	}
+	assert.Equal(t, 2, scheduled)
+
+	for _, id := range webhookIds {
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/webhooks/%d", id), nil)
+		authorize(req)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func testClaims(t *testing.T) {
+	claimant := signInAs(handler, "claimant@example.com", models.RolePlayer, nil)
+	rival := signInAs(handler, "rival@example.com", models.RolePlayer, nil)
+
+	// Users claim a player, one claim at a time
+	var claim models.PlayerClaim
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{{claimant, 200}, {claimant, 409}, {rival, 200}} {
+		req, _ := http.NewRequest("POST", "/players/1/claim", nil)
+		authorizeAs(req, tc.token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code)
+		if tc.token == claimant && tc.code == 200 {
+			json.Unmarshal(w.Body.Bytes(), &claim)
+		}
+	}
+	assert.Equal(t, models.ClaimPending, claim.Status)
+
+	// Until it is approved, the player isn't theirs
+	req, _ := http.NewRequest("POST", "/players/1/picture", nil)
+	authorizeAs(req, claimant)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/claims/%d/approve", claim.Id), nil)
+	authorizeAs(req, claimant)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	req, _ = http.NewRequest("GET", "/claims?status=pending", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var claims []models.PlayerClaim
+	json.Unmarshal(w.Body.Bytes(), &claims)
+	assert.Len(t, claims, 2)
+
+	// Approving a claim turns down the others on the same player
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/claims/%d/approve", claim.Id), nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &claim)
+	assert.Equal(t, models.ClaimApproved, claim.Status)
+	assert.Equal(t, testUserEmail, claim.DecidedBy)
+
+	req, _ = http.NewRequest("GET", "/claims?status=rejected", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &claims)
+	assert.Len(t, claims, 1)
+
+	req, _ = http.NewRequest("POST", "/players/1/claim", nil)
+	authorizeAs(req, rival)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	// The upload URL of the picture is only given to the user the player is
+	req, _ = http.NewRequest("POST", "/players/1/picture", nil)
+	authorizeAs(req, claimant)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "url")
+
+	req, _ = http.NewRequest("PATCH", "/players/1", strings.NewReader(`{"preferredCue": "Mezz"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	authorizeAs(req, claimant)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("PUT", "/players/1", strings.NewReader(`{"name": "TestClaimedPlayer"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "url")
+}
+
+func testPostMatch(t *testing.T) {
+	// Create two players for testing
+	examplePlayer1 := models.Player{
+		Name: "TestPostMatch1",
+	}
+	playerJson, _ := json.Marshal(examplePlayer1)
+	req, _ := http.NewRequest("POST", "/players", strings.NewReader(string(playerJson)))
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	examplePlayer2 := models.Player{
+		Name: "TestPostMatch2",
+	}
+	playerJson, _ = json.Marshal(examplePlayer2)
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(string(playerJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// Create an example match for testing
+	exampleMatch := models.Match{
+		Player1id: 1,
+		Player2id: 2,
+		StartTime: time.Now(),
+	}
+	matchJson, _ := json.Marshal(exampleMatch)
+	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	fmt.Println(w.Body.String())
+	assert.Equal(t, 200, w.Code)
+
+	// Intent to create a match with the same players in the same time
+	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 409, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	var problem models.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "match.table_conflict", problem.Code)
+
+	// Intent to create a match without players
+	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(`{"startTime": "2030-01-01T10:00:00Z"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	problem = models.Problem{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "request.invalid", problem.Code)
+	if assert.Len(t, problem.Errors, 2) {
+		assert.Equal(t, "player1id", problem.Errors[0].Field)
+		assert.Equal(t, "required", problem.Errors[0].Rule)
+	}
+}
+
+func testGetMatches(t *testing.T) {
+	// Get all matches
+	req, _ := http.NewRequest("GET", "/matches", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	// Eval if the created match is in the list
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+
+	assert.Greater(t, len(matches), 0)
+	assert.Equal(t, 1, matches[0].Player1id)
+
+	// Get the match by status
+	req, _ = http.NewRequest("GET", "/matches?status=upcoming", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+
+	assert.Greater(t, len(matches), 0)
+
+	// Filter the matches by player and table
+	req, _ = http.NewRequest("GET", "/matches?playerId=2&tableNumber=0", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 1, len(matches))
+
+	req, _ = http.NewRequest("GET", "/matches?tableNumber=5", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 0, len(matches))
+
+	// Filter the matches by start time
+	req, _ = http.NewRequest("GET", "/matches?from=2000-01-01T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 1, len(matches))
+
+	req, _ = http.NewRequest("GET", "/matches?to=2000-01-01T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 0, len(matches))
+
+	// Only whitelisted fields can be sorted by
+	req, _ = http.NewRequest("GET", "/matches?sort=winner_id", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+}
+
+func testPagePlayers(t *testing.T) {
+	// The first page links to the next one
+	req, _ := http.NewRequest("GET", "/players?sort=-name&limit=1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	var players []models.Player
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 1, len(players))
+	assert.Equal(t, "TestPostMatch2", players[0].Name)
+
+	link := w.Header().Get("Link")
+	assert.True(t, strings.HasSuffix(link, `>; rel="next"`))
+
+	// Follow the link to the second page
+	req, _ = http.NewRequest("GET", strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	json.Unmarshal(w.Body.Bytes(), &players)
+	assert.Equal(t, 1, len(players))
+	assert.Equal(t, "TestPostMatch1", players[0].Name)
+
+	// A cursor can't be reused with another sort
+	req, _ = http.NewRequest("GET", strings.Replace(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), "sort=-name", "sort=name", 1), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+	// The next page continues after the name the last player had, even once
+	// it has been renamed
+	req, _ = http.NewRequest("PUT", "/players/2", strings.NewReader(`{"name": "ATestPostMatch2"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &players)
+	if assert.Equal(t, 1, len(players)) {
+		assert.Equal(t, "TestPostMatch1", players[0].Name)
+	}
+
+	req, _ = http.NewRequest("PUT", "/players/2", strings.NewReader(`{"name": "TestPostMatch2"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func testGetMatch(t *testing.T) {
+	// Get the created match
+	req, _ := http.NewRequest("GET", "/matches/1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	// Eval if the match is the created match
+	var match models.Match
+	json.Unmarshal(w.Body.Bytes(), &match)
+
+	assert.Equal(t, 1, match.Player1id)
+}
+
+func testPutMatch(t *testing.T) {
+	// Update the created match
+	exampleMatch := models.Match{
+		Player1id: 1,
+		Player2id: 2,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		WinnerId:  2,
+	}
+	matchJson, _ := json.Marshal(exampleMatch)
+	req, _ := http.NewRequest("PUT", "/matches/1", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// Get the updated match
+	req, _ = http.NewRequest("GET", "/matches/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// Check if the match was updated
+	var match models.Match
+	json.Unmarshal(w.Body.Bytes(), &match)
+
+	assert.Equal(t, exampleMatch.EndTime.Format("2006-01-02 15:04:05"), match.EndTime.Format("2006-01-02 15:04:05"))
+
+	// Assert that the winner got the points
+	req, _ = http.NewRequest("GET", "/players/2", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var player models.Player
+	json.Unmarshal(w.Body.Bytes(), &player)
+
+	assert.Equal(t, 1, player.Points)
+
+	// Send the same result again, the winner must not get the points twice
+	req, _ = http.NewRequest("PUT", "/matches/1", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/players/2", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &player)
+
+	assert.Equal(t, 1, player.Points)
+
+	// Correct the winner, the points move from the old winner to the new one
+	exampleMatch.WinnerId = 1
+	matchJson, _ = json.Marshal(exampleMatch)
+	req, _ = http.NewRequest("PUT", "/matches/1", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/players/2", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &player)
+
+	assert.Equal(t, 0, player.Points)
+
+	req, _ = http.NewRequest("GET", "/players/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &player)
+
+	assert.Equal(t, 1, player.Points)
+
+	// A winner that did not play the match is rejected
+	exampleMatch.WinnerId = 3
+	matchJson, _ = json.Marshal(exampleMatch)
+	req, _ = http.NewRequest("PUT", "/matches/1", strings.NewReader(string(matchJson)))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func testGetStandings(t *testing.T) {
+	// Only the corrected result counts
+	req, _ := http.NewRequest("GET", "/standings", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	var standings []models.Standing
+	json.Unmarshal(w.Body.Bytes(), &standings)
+
+	assert.Equal(t, []models.Standing{
+		{PlayerId: 1, Ranking: 1, Points: 1, Played: 1, Wins: 1},
+		{PlayerId: 2, Ranking: 2, Points: 0, Played: 1, Losses: 1},
+	}, standings)
+
+	// Replaying the history gives the same points
+	assertStandingsReplayed(t)
+	err := runCommand(context.Background(), dbConn, []string{"replay", "-scoring", "default"})
+	assert.Nil(t, err)
+
+	req, _ = http.NewRequest("GET", "/players/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var player models.Player
+	json.Unmarshal(w.Body.Bytes(), &player)
+
+	assert.Equal(t, 1, player.Points)
+	assert.Equal(t, 1, player.Ranking)
+}
+
+// assertStandingsReplayed checks the points and rankings kept up to date event
+// by event are those a replay of the whole match history gives.
+func assertStandingsReplayed(t *testing.T) {
+	projection, err := models.ReplayMatchEvents(context.Background(), dbConn, nil)
+	assert.Nil(t, err)
+	replayed := map[int]models.Standing{}
+	for _, standing := range projection.Standings() {
+		replayed[standing.PlayerId] = standing
+	}
+
+	players, err := models.SelectAllPlayers(context.Background(), dbConn, true)
+	assert.Nil(t, err)
+	for _, player := range players {
+		assert.Equal(t, replayed[player.Id].Points, player.Points, "points of %s", player.Name)
+		assert.Equal(t, replayed[player.Id].Ranking, player.Ranking, "ranking of %s", player.Name)
+	}
+}
+
+func testDeleteMatch(t *testing.T) {
+	// Delete the created match
+	req, _ := http.NewRequest("DELETE", "/matches/1", nil)
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	// Check if the match was deleted
+	req, _ = http.NewRequest("GET", "/matches/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+
+	assertStandingsReplayed(t)
+}
+
+func testRestoreMatch(t *testing.T) {
+	// The deleted match is hidden from the list unless asked for
+	req, _ := http.NewRequest("GET", "/matches", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 0, len(matches))
+
+	req, _ = http.NewRequest("GET", "/matches?includeDeleted=true", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 1, len(matches))
+
+	// Only admins see deleted matches
+	req, _ = http.NewRequest("GET", "/matches?includeDeleted=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	// It can't be restored while another match has its table
+	res, err := dbConn.Exec("INSERT INTO matches (player1_id, player2_id, start_time, end_time, table_number) SELECT player2_id, player1_id, start_time, end_time, table_number FROM matches WHERE id = 1")
+	assert.Nil(t, err)
+	blocking, _ := res.LastInsertId()
+	req, _ = http.NewRequest("POST", "/matches/1/restore", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+	var problem models.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "match.table_conflict", problem.Code)
+	_, err = dbConn.Exec("DELETE FROM matches WHERE id = ?", blocking)
+	assert.Nil(t, err)
+
+	// Restore the deleted match
+	req, _ = http.NewRequest("POST", "/matches/1/restore", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/matches/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	assertStandingsReplayed(t)
+}
+
+func testGetAuditEvents(t *testing.T) {
+	// Every change made to the match is in its audit log
+	req, _ := http.NewRequest("GET", "/audit?entity=match&id=1", nil)
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	var events []models.AuditEvent
+	json.Unmarshal(w.Body.Bytes(), &events)
+
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{"create", "update", "update", "update", "delete", "restore"}, actions)
+	assert.Equal(t, testUserEmail, events[0].Actor)
+
+	// The correction of the winner keeps the old and the new value
+	var diff map[string]struct {
+		Old any `json:"old"`
+		New any `json:"new"`
+	}
+	json.Unmarshal(events[3].Diff, &diff)
+	assert.Equal(t, float64(2), diff["winnerId"].Old)
+	assert.Equal(t, float64(1), diff["winnerId"].New)
+
+	// A change whose audit event can't be written isn't saved either
+	handler.DbConn.Exec("CREATE TRIGGER audit_events_down BEFORE INSERT ON audit_events BEGIN SELECT RAISE(ABORT, 'audit log down'); END")
+	req, _ = http.NewRequest("POST", "/players", strings.NewReader(`{"name": "TestAuditDown"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	handler.DbConn.Exec("DROP TRIGGER audit_events_down")
+	assert.Equal(t, 500, w.Code)
+
+	req, _ = http.NewRequest("GET", "/players?name=TestAuditDown", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "[]", w.Body.String())
+
+	// Unknown entities are rejected
+	req, _ = http.NewRequest("GET", "/audit?entity=table", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+	// Only organisers and admins read the log
+	req, _ = http.NewRequest("GET", "/audit", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	req, _ = http.NewRequest("GET", "/audit", nil)
+	authorizeAs(req, signInAs(handler, "audit-player@example.com", models.RolePlayer, nil))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	req, _ = http.NewRequest("GET", "/audit", nil)
+	authorizeAs(req, signInAs(handler, "audit-organiser@example.com", models.RoleOrganiser, nil))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func testImport(t *testing.T) {
+	// Import users from CSV, the one without a name is left out
+	body := "name,ranking,preferredCue\nTestImport1,3,Predator\n,4,Mezz\nTestImport2,0,\n"
+	req, _ := http.NewRequest("POST", "/import/players?mode=bestEffort", strings.NewReader(body))
+	authorize(req)
+	req.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var report models.ImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 1, report.Failed)
+	if assert.Len(t, report.Rows, 3) {
+		assert.Equal(t, "failed", report.Rows[1].Status)
+		assert.Equal(t, "request.invalid", report.Rows[1].Error.Code)
+	}
+	player1, player2 := report.Rows[0].Id, report.Rows[2].Id
+
+	// Import matches from NDJSON, the second one takes the table of the first
+	body = fmt.Sprintf(`{"player1id": %d, "player2id": %d, "startTime": "2031-05-01T18:00:00Z", "tableNumber": 7}
+{"player1id": %d, "player2id": %d, "startTime": "2031-05-01T18:30:00Z", "tableNumber": 7}
+`, player1, player2, player2, player1)
+	req, _ = http.NewRequest("POST", "/import/matches", strings.NewReader(body))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+
+	report = models.ImportReport{}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 0, report.Created)
+	if assert.Len(t, report.Rows, 2) {
+		assert.Equal(t, "skipped", report.Rows[0].Status)
+		assert.Equal(t, "match.table_conflict", report.Rows[1].Error.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/matches?tableNumber=7", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 0, len(matches))
+
+	// The same import in best effort mode creates the first match
+	req, _ = http.NewRequest("POST", "/import/matches?mode=bestEffort", strings.NewReader(body))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/matches?tableNumber=7", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Equal(t, 1, len(matches))
+
+	assertStandingsReplayed(t)
+}
+
+func testExport(t *testing.T) {
+	// Export the matches of table 7 as CSV, with the names of the players
+	req, _ := http.NewRequest("GET", "/export/matches?tableNumber=7", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "player1Name", records[0][2])
+		assert.Equal(t, "TestImport1", records[1][2])
+		assert.Equal(t, "TestImport2", records[1][4])
+	}
+
+	// Export the players as a spreadsheet
+	req, _ = http.NewRequest("GET", "/export/players?format=xlsx&sort=-name", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if assert.Nil(t, err) {
+		sheet, err := archive.Open("xl/worksheets/sheet1.xml")
+		assert.Nil(t, err)
+		content, _ := io.ReadAll(sheet)
+		assert.Contains(t, string(content), "TestImport2")
+	}
+
+	// Export the standings as NDJSON
+	req, _ = http.NewRequest("GET", "/export/standings?format=ndjson", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var standing models.ExportedStanding
+	err = json.NewDecoder(w.Body).Decode(&standing)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, standing.PlayerName)
+
+	// Names that look like formulas stay text in a spreadsheet
+	_, err = models.Player{Name: `=HYPERLINK("http://example.com","TestExportFormula")`}.Create(context.Background(), dbConn)
+	assert.Nil(t, err)
+	req, _ = http.NewRequest("GET", "/export/players?name=TestExportFormula", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	records, err = csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, `'=HYPERLINK("http://example.com","TestExportFormula")`, records[1][1])
+	}
+
+	// Text cells of a spreadsheet are never formulas, they keep the name as is
+	req, _ = http.NewRequest("GET", "/export/players?name=TestExportFormula&format=xlsx", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	archive, err = zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if assert.Nil(t, err) {
+		sheet, err := archive.Open("xl/worksheets/sheet1.xml")
+		assert.Nil(t, err)
+		content, _ := io.ReadAll(sheet)
+		assert.Contains(t, string(content), `<t xml:space="preserve">=HYPERLINK(`)
+	}
+
+	// Filters are checked before the export starts
+	req, _ = http.NewRequest("GET", "/export/players?sort=unknown", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+	// Nothing is held open while the rows are written, writes go through
+	var written bool
+	err = models.EachMatch(context.Background(), dbConn, models.MatchFilter{}, "", func(models.ExportedMatch) error {
+		if written {
+			return nil
+		}
+		written = true
+		_, err := models.Player{Name: "TestExportConcurrentWrite"}.Create(context.Background(), dbConn)
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func testFollowMatch(t *testing.T) {
+	// Create a match to follow
+	req, _ := http.NewRequest("POST", "/matches", strings.NewReader(`{"player1id": 1, "player2id": 2, "startTime": "2032-01-01T18:00:00Z", "tableNumber": 9}`))
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/matches?tableNumber=9", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	assert.Len(t, matches, 1)
+	matchUrl := fmt.Sprintf("/matches/%d", matches[0].Id)
+
+	// Follow it over Server-Sent Events while its result is recorded
+	streamCtx, cancel := context.WithCancel(context.Background())
+	streamReq, _ := http.NewRequestWithContext(streamCtx, "GET", matchUrl+"/events", nil)
+	stream := httptest.NewRecorder()
+	streamed := make(chan struct{})
+	go func() {
+		router.ServeHTTP(stream, streamReq)
+		close(streamed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	req, _ = http.NewRequest("PATCH", matchUrl, strings.NewReader(`{"winnerId": 1}`))
+	authorize(req)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-streamed
+	assert.Equal(t, "text/event-stream", stream.Header().Get("Content-Type"))
+	assert.Contains(t, stream.Body.String(), "event: MatchScheduled")
+	assert.Contains(t, stream.Body.String(), "event: ResultRecorded")
+
+	// A scoreboard resuming after the first event only gets the result
+	var scheduledId int
+	fmt.Sscanf(stream.Body.String(), "id: %d", &scheduledId)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s%s/ws?lastEventId=%d", strings.TrimPrefix(server.URL, "http"), matchUrl, scheduledId), nil)
+	if assert.Nil(t, err) {
+		defer conn.Close()
+		var event models.MatchEvent
+		err = conn.ReadJSON(&event)
+		assert.Nil(t, err)
+		assert.Equal(t, "ResultRecorded", event.Type)
+		assert.Equal(t, 1, event.WinnerId)
+	}
+}
+
+func testGraphql(t *testing.T) {
+	// Get the matches of table 7 with their players, and the players' history
+	query := `{"query": "query($table: Int) { matches(tableNumber: $table) { id player1 { name matches { id } } player2 { name stats { played } } winner { name } } }", "variables": {"table": 7}}`
+	req, _ := http.NewRequest("POST", "/graphql", strings.NewReader(query))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var result struct {
+		Data struct {
+			Matches []struct {
+				Id      int
+				Player1 struct {
+					Name    string
+					Matches []struct{ Id int }
+				}
+				Player2 struct {
+					Name  string
+					Stats *struct{ Played int }
+				}
+				Winner *struct{ Name string }
+			}
+		}
+		Errors []any
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Empty(t, result.Errors)
+	if assert.Len(t, result.Data.Matches, 1) {
+		match := result.Data.Matches[0]
+		assert.Equal(t, "TestImport1", match.Player1.Name)
+		assert.Equal(t, "TestImport2", match.Player2.Name)
+		assert.Len(t, match.Player1.Matches, 1)
+		assert.Nil(t, match.Player2.Stats)
+		assert.Nil(t, match.Winner)
+	}
+
+	// A missing player is reported without internal details
+	req, _ = http.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ player(id: 999) { name } }"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "Player with id 999 not found")
+
+	// Only admins see deleted matches
+	req, _ = http.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ matches(includeDeleted: true) { id } }"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "Only admins can list deleted records")
+}
+
+func testRoles(t *testing.T) {
+	playerId := 2
+	organiser := signInAs(handler, "organiser@example.com", models.RoleOrganiser, nil)
+	referee := signInAs(handler, "referee@example.com", models.RoleReferee, nil)
+	player := signInAs(handler, "player@example.com", models.RolePlayer, &playerId)
+
+	// Only organisers schedule matches
+	body := `{"player1id": 1, "player2id": 2, "startTime": "2034-01-01T18:00:00Z", "tableNumber": 12}`
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{{player, 403}, {referee, 403}, {organiser, 200}} {
+		req, _ := http.NewRequest("POST", "/matches", strings.NewReader(body))
+		authorizeAs(req, tc.token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code)
+		if tc.code == 403 {
+			var problem models.Problem
+			json.Unmarshal(w.Body.Bytes(), &problem)
+			assert.Equal(t, "auth.forbidden", problem.Code)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/matches?tableNumber=12", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	if !assert.Len(t, matches, 1) {
+		return
+	}
+	matchUrl := fmt.Sprintf("/matches/%d", matches[0].Id)
+
+	// Referees record results but don't reschedule, organisers the other way round
+	for _, tc := range []struct {
+		token string
+		patch string
+		code  int
+	}{
+		{referee, `{"tableNumber": 13}`, 403},
+		{organiser, `{"winnerId": 1}`, 403},
+		{referee, `{"winnerId": 1}`, 200},
+		{organiser, `{"tableNumber": 13}`, 200},
+		{player, `{"winnerId": 2}`, 403},
+	} {
+		req, _ = http.NewRequest("PATCH", matchUrl, strings.NewReader(tc.patch))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		authorizeAs(req, tc.token)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.patch)
+	}
+
+	// Players change the preferred cue of their own player only
+	for _, tc := range []struct {
+		url   string
+		patch string
+		code  int
+	}{
+		{"/players/2", `{"preferredCue": "Cuetec"}`, 200},
+		{"/players/2", `{"name": "Someone else"}`, 403},
+		{"/players/1", `{"preferredCue": "Cuetec"}`, 403},
+	} {
+		req, _ = http.NewRequest("PATCH", tc.url, strings.NewReader(tc.patch))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		authorizeAs(req, player)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.url+" "+tc.patch)
+	}
+
+	// Only admins manage users
+	req, _ = http.NewRequest("GET", "/users", nil)
+	authorizeAs(req, organiser)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	req, _ = http.NewRequest("GET", "/users", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var users []models.User
+	json.Unmarshal(w.Body.Bytes(), &users)
+	var organiserId int
+	for _, user := range users {
+		if user.Email == "organiser@example.com" {
+			organiserId = user.Id
+		}
+	}
+
+	// A new role applies to the tokens issued before
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/users/%d", organiserId), strings.NewReader(`{"role": "referee"}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("POST", "/matches", strings.NewReader(`{"player1id": 1, "player2id": 2, "startTime": "2034-02-01T18:00:00Z", "tableNumber": 12}`))
+	authorizeAs(req, organiser)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+}
+
+func testGrpc(t *testing.T) {
+	// Serve the gRPC API in memory
+	listener := bufconn.Listen(1 << 20)
+	panicking := func(ctx context.Context) {
+		if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("x-test-panic")) > 0 {
+			panic("test panic")
+		}
+	}
+	server := handlers.NewGrpcServer(handler, grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+		panicking(ctx)
+		return next(ctx, req)
+	}), grpc.ChainStreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+		panicking(stream.Context())
+		return next(srv, stream)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	client := poolpb.NewPoolServiceClient(conn)
+	authCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+
+	// A panic fails the call with an internal error, the server keeps serving
+	panicCtx := metadata.AppendToOutgoingContext(context.Background(), "x-test-panic", "1")
+	_, err = client.ListPlayers(panicCtx, &poolpb.ListPlayersRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	events, err := client.WatchMatch(panicCtx, &poolpb.WatchMatchRequest{Id: 1})
+	if assert.Nil(t, err) {
+		_, err = events.Recv()
+		assert.Equal(t, codes.Internal, status.Code(err))
+	}
+	_, err = client.ListPlayers(context.Background(), &poolpb.ListPlayersRequest{})
+	assert.Nil(t, err)
+
+	// Changes need a signed in user, as over REST
+	_, err = client.DeleteMatch(context.Background(), &poolpb.DeleteMatchRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// And a user allowed to make them
+	refereeCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signInAs(handler, "grpc-referee@example.com", models.RoleReferee, nil))
+	_, err = client.DeleteMatch(refereeCtx, &poolpb.DeleteMatchRequest{Id: 1})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Schedule a match, it follows the same rules as over REST
+	match, err := client.CreateMatch(authCtx, &poolpb.CreateMatchRequest{Match: &poolpb.Match{Player1Id: 1, Player2Id: 2, StartTime: timestamppb.New(time.Date(2033, 1, 1, 18, 0, 0, 0, time.UTC)), TableNumber: 11}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int32(1), match.Version)
+
+	tableNumber := int32(11)
+	matches, err := client.ListMatches(context.Background(), &poolpb.ListMatchesRequest{TableNumber: &tableNumber})
+	assert.Nil(t, err)
+	assert.Len(t, matches.Matches, 1)
+	assert.Empty(t, matches.NextCursor)
+
+	// Only admins see deleted matches
+	_, err = client.ListMatches(refereeCtx, &poolpb.ListMatchesRequest{IncludeDeleted: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Watch it while its result is recorded
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.WatchMatch(streamCtx, &poolpb.WatchMatchRequest{Id: match.Id})
+	assert.Nil(t, err)
+	event, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, "MatchScheduled", event.Type)
+
+	match.WinnerId = 2
+	match, err = client.UpdateMatch(authCtx, &poolpb.UpdateMatchRequest{Match: match})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), match.Version)
+	event, err = stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, "ResultRecorded", event.Type)
+	assert.Equal(t, int64(2), event.WinnerId)
+
+	// Streams are authenticated like the other calls
+	apiKey := postApiKey(t, `{"name": "grpc-players", "scopes": ["players:read"]}`)
+	for _, tc := range []struct {
+		key, value string
+		code       codes.Code
+	}{
+		{"authorization", "Bearer not-a-token", codes.Unauthenticated},
+		{"x-api-key", apiKey.Key, codes.PermissionDenied},
+	} {
+		denied, err := client.WatchMatch(metadata.AppendToOutgoingContext(context.Background(), tc.key, tc.value), &poolpb.WatchMatchRequest{Id: match.Id})
+		if assert.Nil(t, err) {
+			_, err = denied.Recv()
+			assert.Equal(t, tc.code, status.Code(err), tc.key)
+		}
+	}
+
+	handler.DbConn.Exec("DELETE FROM api_keys WHERE id = ?", apiKey.Id)
+
+	// Calls no permission is set for are refused
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Problems turn into status codes with their code as the reason
+	match.WinnerId = 3
+	_, err = client.UpdateMatch(authCtx, &poolpb.UpdateMatchRequest{Match: match})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	details := status.Convert(err).Details()
+	if assert.NotEmpty(t, details) {
+		assert.Equal(t, "match.invalid_winner", details[0].(*errdetails.ErrorInfo).Reason)
+	}
+
+	_, err = client.DeleteMatch(authCtx, &poolpb.DeleteMatchRequest{Id: match.Id, Version: 1})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = client.GetMatch(context.Background(), &poolpb.GetMatchRequest{Id: 9999})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	assertStandingsReplayed(t)
+}
+
+// postApiKey creates an API key as the test user.
+func postApiKey(t *testing.T, body string) models.ApiKey {
+	var apiKey models.ApiKey
+
+	req, _ := http.NewRequest("POST", "/api-keys", strings.NewReader(body))
+	authorize(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &apiKey)
+	return apiKey
+}
+
+func testApiKeys(t *testing.T) {
+	organiser := signInAs(handler, "keys-organiser@example.com", models.RoleOrganiser, nil)
+
+	// Only admins manage keys, which only get the scopes a service may have
+	req, _ := http.NewRequest("POST", "/api-keys", strings.NewReader(`{"name": "scoreboard", "scopes": ["matches:read"]}`))
+	authorizeAs(req, organiser)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	req, _ = http.NewRequest("POST", "/api-keys", strings.NewReader(`{"name": "scoreboard", "scopes": ["users:manage"]}`))
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	apiKey := postApiKey(t, `{"name": "scoreboard", "scopes": ["matches:read", "results:write"]}`)
+	assert.True(t, strings.HasPrefix(apiKey.Key, apiKey.Prefix+"_"))
+	assert.Equal(t, models.DefaultApiKeyRateLimit, apiKey.RateLimit)
+	assert.Equal(t, testUserEmail, apiKey.CreatedBy)
+
+	// Keys are accepted where tokens are, within their scopes
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"GET", "/matches", "", 200},
+		{"GET", "/players", "", 403},
+		{"POST", "/matches", `{"player1id": 1, "player2id": 2, "startTime": "2035-01-01T18:00:00Z", "tableNumber": 3}`, 403},
+	} {
+		req, _ = http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		req.Header.Set("X-API-Key", apiKey.Key)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.method+" "+tc.url)
+	}
+
+	req, _ = http.NewRequest("GET", "/matches?tableNumber=13", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var matches []models.Match
+	json.Unmarshal(w.Body.Bytes(), &matches)
+	if !assert.NotEmpty(t, matches) {
+		return
+	}
+	matchId := fmt.Sprint(matches[0].Id)
+	req, _ = http.NewRequest("PATCH", "/matches/"+matchId, strings.NewReader(`{"winnerId": 2}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("X-API-Key", apiKey.Key)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/audit?entity=match&id="+matchId, nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var events []models.AuditEvent
+	json.Unmarshal(w.Body.Bytes(), &events)
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, "apikey:"+apiKey.Prefix, events[len(events)-1].Actor)
+	}
+
+	// Listing shows when keys were last used, never the keys
+	req, _ = http.NewRequest("GET", "/api-keys", nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), apiKey.Key)
+	var apiKeys []models.ApiKey
+	json.Unmarshal(w.Body.Bytes(), &apiKeys)
+	if assert.Len(t, apiKeys, 1) {
+		assert.NotNil(t, apiKeys[0].LastUsedAt)
+	}
+
+	// Keys are held to their rate limit
+	limited := postApiKey(t, `{"name": "poller", "scopes": ["matches:read"], "rateLimit": 2}`)
+	for _, code := range []int{200, 200, 429} {
+		req, _ = http.NewRequest("GET", "/matches", nil)
+		req.Header.Set("X-API-Key", limited.Key)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code)
+	}
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Rotating replaces the key, revoking stops it
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api-keys/%d/rotate", apiKey.Id), nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var rotated models.ApiKey
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	assert.NotEqual(t, apiKey.Key, rotated.Key)
+	assert.Equal(t, apiKey.Scopes, rotated.Scopes)
+
+	for _, tc := range []struct {
+		key  string
+		code int
+	}{{apiKey.Key, 401}, {rotated.Key, 200}, {"pk_000000000000_nope", 401}} {
+		req, _ = http.NewRequest("GET", "/matches", nil)
+		req.Header.Set("X-API-Key", tc.key)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api-keys/%d", apiKey.Id), nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req, _ = http.NewRequest("GET", "/matches", nil)
+	req.Header.Set("X-API-Key", rotated.Key)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	var problem models.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "auth.invalid_api_key", problem.Code)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api-keys/%d", apiKey.Id), nil)
+	authorize(req)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func testRateLimits(t *testing.T) {
+	limited := handler
+	limited.RateLimitStore = handlers.NewMemoryRateLimitStore()
+	limited.RateLimits = handlers.RateLimits{
+		handlers.RateLimitAuth: {Requests: 1, Period: time.Minute},
+		handlers.RateLimitRead: {Requests: 2, Period: time.Minute},
+	}
+	limitedRouter := setupRouter(limited)
+	get := func(remoteAddr string, header string, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/players", nil)
+		req.RemoteAddr = remoteAddr
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		limitedRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	// Anonymous clients are limited by IP, and told where they stand
+	for _, remaining := range []string{"1", "0"} {
+		w := get("192.0.2.1:1234", "", "")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, remaining, w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	}
+	w := get("192.0.2.1:1234", "", "")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	var problem models.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "rate_limit.exceeded", problem.Code)
+
+	// X-Forwarded-For is only trusted from trusted proxies
+	w = get("192.0.2.1:1234", "X-Forwarded-For", "203.0.113.9")
+	assert.Equal(t, 429, w.Code)
+	w = get("192.0.2.2:1234", "", "")
+	assert.Equal(t, 200, w.Code)
+
+	// Users have buckets of their own
+	w = get("192.0.2.1:1234", "Authorization", "Bearer "+token)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+
+	// Signing in is limited separately
+	for _, code := range []int{401, 429} {
+		req, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(`{"email": "nobody@example.com", "password": "wrong-password"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w = httptest.NewRecorder()
+		limitedRouter.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code)
+	}
+
+	// Bad credentials are limited by IP before they are checked
+	limited.RateLimits = handlers.RateLimits{handlers.RateLimitIp: {Requests: 2, Period: time.Minute}}
+	limitedRouter = setupRouter(limited)
+	for _, code := range []int{401, 401, 429} {
+		w = get("192.0.2.3:1234", "Authorization", "Bearer bad-token")
+		assert.Equal(t, code, w.Code)
+	}
+	w = get("192.0.2.3:1234", "X-API-Key", "bad-key")
+	assert.Equal(t, 429, w.Code)
+
+	// Buckets refill over their period
+	var bucket handlers.Bucket
+	limit := handlers.Limit{Requests: 2, Period: time.Minute}
+	now := time.Now()
+	assert.True(t, bucket.Take(limit, now).Allowed)
+	assert.True(t, bucket.Take(limit, now).Allowed)
+	result := bucket.Take(limit, now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 30*time.Second, result.RetryAfter)
+	assert.True(t, bucket.Take(limit, now.Add(30*time.Second)).Allowed)
+}
+
+func testHealth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// The storage may not be reachable where the tests run, the database is
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var readiness handlers.Readiness
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	assert.Equal(t, "ok", readiness.Checks["database"].Status)
+	assert.Equal(t, "ok", readiness.Checks["migrations"].Status)
+	if assert.Contains(t, readiness.Checks, "storage") && readiness.Checks["storage"].Status == "ok" {
+		assert.Equal(t, 200, w.Code)
+	} else {
+		assert.Equal(t, 503, w.Code)
+	}
+
+	// A database yet to be migrated isn't ready
+	unmigrated, _ := openDatabase(t.TempDir() + "/unmigrated.db")
+	defer unmigrated.Close()
+	h := handler
+	h.DbConn = unmigrated
+	readiness = h.Ready(context.Background())
+	assert.Equal(t, "failed", readiness.Status)
+	assert.Equal(t, "ok", readiness.Checks["database"].Status)
+	assert.Contains(t, readiness.Checks["migrations"].Error, "api_keys")
+	models.Migrate(unmigrated)
+	readiness = h.Ready(context.Background())
+	assert.Equal(t, "ok", readiness.Checks["migrations"].Status)
+}
+
+// metricValue scrapes the value of the series, zero when it has none yet.
+func metricValue(t *testing.T, series string) float64 {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var value float64
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if rest, ok := strings.CutPrefix(line, series+" "); ok {
+			fmt.Sscan(rest, &value)
+		}
+	}
+	return value
+}
+
+func testMetrics(t *testing.T) {
+	created := metricValue(t, "pool_matches_created_total")
+	conflicts := metricValue(t, `pool_booking_conflicts_total{conflict="table"}`)
+
+	// A match, then another at the same table and time
+	body := `{"player1id": 1, "player2id": 2, "startTime": "2035-01-01T18:00:00Z", "tableNumber": 14}`
+	for _, code := range []int{200, 409} {
+		req, _ := http.NewRequest("POST", "/matches", strings.NewReader(body))
+		authorize(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code)
+	}
+	assert.Equal(t, created+1, metricValue(t, "pool_matches_created_total"))
+	assert.Equal(t, conflicts+1, metricValue(t, `pool_booking_conflicts_total{conflict="table"}`))
+
+	// Imported matches count too, those an atomic import left out don't
+	body = `{"player1id": 1, "player2id": 2, "startTime": "2035-02-01T18:00:00Z", "tableNumber": 14}
+{"player1id": 1, "player2id": 1, "startTime": "2035-02-02T18:00:00Z", "tableNumber": 14}
+`
+	for _, mode := range []string{"atomic", "bestEffort"} {
+		req, _ := http.NewRequest("POST", "/import/matches?mode="+mode, strings.NewReader(body))
+		authorize(req)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+	}
+	assert.Equal(t, created+2, metricValue(t, "pool_matches_created_total"))
+
+	// Requests are timed by route, queries by table
+	assert.Positive(t, metricValue(t, `pool_http_request_duration_seconds_count{method="POST",route="/matches",status="409"}`))
+	assert.Positive(t, metricValue(t, `pool_db_query_duration_seconds_count{table="matches"}`))
+}
+
+func testRequestId(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(handlers.NewLogger(&logs, slog.LevelInfo))
+
+	// A forwarded id is kept and logged with the request
+	req, _ := http.NewRequest("GET", "/players/999999", nil)
+	req.Header.Set("X-Request-ID", "edge-42")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "edge-42", w.Header().Get("X-Request-ID"))
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	assert.Equal(t, "Request", record["msg"])
+	assert.Equal(t, "edge-42", record["request_id"])
+	assert.Equal(t, float64(404), record["status"])
+
+	// Requests without a usable one get a new one
+	for _, forwarded := range []string{"", "forged\nline", strings.Repeat("x", 200)} {
+		req, _ = http.NewRequest("GET", "/players/1", nil)
+		req.Header.Set("X-Request-ID", forwarded)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Len(t, w.Header().Get("X-Request-ID"), 32)
+	}
 }
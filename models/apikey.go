@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultApiKeyRateLimit is how many requests a minute an API key may make,
+// unless it was given another limit.
+const DefaultApiKeyRateLimit = 60
+
+// apiKeyPrefixLength is the length of the start of a key that is kept in the
+// clear, "pk_" and 12 hex characters, to find the key and tell keys apart.
+const apiKeyPrefixLength = 15
+
+// apiKeyTouchInterval is how often the last use of a key is written at most,
+// so busy keys don't write on every request.
+const apiKeyTouchInterval = time.Minute
+
+var errInvalidApiKey = NewProblem(http.StatusUnauthorized, "auth.invalid_api_key", "API key is invalid or revoked")
+
+const apiKeyColumns = "id, name, prefix, key_hash, scopes, rate_limit, created_by, created_at, last_used_at, revoked_at"
+
+func CreateApiKeysTable(dbConn *sql.DB) (sql.Result, error) {
+	return dbConn.Exec("CREATE TABLE IF NOT EXISTS api_keys (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, prefix TEXT UNIQUE, key_hash TEXT, scopes TEXT, rate_limit INTEGER, created_by TEXT, created_at DATETIME, last_used_at DATETIME, revoked_at DATETIME)")
+}
+
+// ApiKey lets a service use the API without a user. Keys are stored hashed,
+// so Key is only shown when the key is created or rotated.
+type ApiKey struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name" binding:"required,max=100"`
+	Prefix     string     `json:"prefix"` // the start of the key, to tell keys apart
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes" binding:"required,min=1,dive,oneof=players:read matches:read players:create players:update players:delete matches:create matches:update matches:delete results:write"`
+	RateLimit  int        `json:"rateLimit" binding:"omitempty,min=1,max=10000"` // requests a minute, 60 when not given
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	keyHash    string
+}
+
+// HasScope tells whether the key may do what permission allows.
+func (k ApiKey) HasScope(permission string) bool {
+	for _, scope := range k.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// hashApiKey hashes a key with SHA-256. Keys are long and random, unlike
+// passwords, so a slow hash adds nothing.
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newApiKey generates a key, "pk_", 12 hex characters that are its prefix, an
+// underscore and 48 more.
+func newApiKey() (key string, prefix string, err error) {
+	random := make([]byte, 30)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", "", err
+	}
+	encoded := hex.EncodeToString(random)
+	prefix = "pk_" + encoded[:12]
+	return prefix + "_" + encoded[12:], prefix, nil
+}
+
+// Create generates the key and saves it hashed, recording its creation by
+// k.CreatedBy in the audit log.
+func (k *ApiKey) Create(ctx context.Context, dbConn *sql.DB) (sql.Result, error) {
+	var err error
+
+	k.Key, k.Prefix, err = newApiKey()
+	if err != nil {
+		return nil, err
+	}
+	if k.RateLimit == 0 {
+		k.RateLimit = DefaultApiKeyRateLimit
+	}
+	k.CreatedAt = time.Now().UTC()
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO api_keys (name, prefix, key_hash, scopes, rate_limit, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		k.Name, k.Prefix, hashApiKey(k.Key), strings.Join(k.Scopes, ","), k.RateLimit, k.CreatedBy, k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	k.Id = int(id)
+	created := *k
+	created.Key = ""
+	err = recordAudit(ctx, tx, k.CreatedBy, "apikey", fmt.Sprintf("%d", k.Id), "create", nil, created)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit()
+}
+
+func SelectApiKeys(ctx context.Context, dbConn *sql.DB) ([]ApiKey, error) {
+	return selectApiKeysWhere(ctx, dbConn, "1 = 1 ORDER BY id")
+}
+
+func SelectApiKeyById(ctx context.Context, dbConn *sql.DB, id int) (ApiKey, error) {
+	return selectApiKeyById(ctx, dbConn, id)
+}
+
+func selectApiKeyById(ctx context.Context, dbConn querier, id int) (ApiKey, error) {
+	keys, err := selectApiKeysWhere(ctx, dbConn, "id = ?", id)
+	if err != nil {
+		return ApiKey{}, err
+	} else if len(keys) == 0 {
+		return ApiKey{}, NewProblem(http.StatusNotFound, "api_key.not_found", fmt.Sprintf("API key with id %d not found", id))
+	}
+	return keys[0], nil
+}
+
+// RotateApiKey replaces the key with id by a new one with the same name,
+// scopes and limit, and records the change by actor in the audit log. The old
+// key stops working at once.
+func RotateApiKey(ctx context.Context, dbConn *sql.DB, id int, actor string) (ApiKey, error) {
+	key, prefix, err := newApiKey()
+	if err != nil {
+		return ApiKey{}, err
+	}
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := selectApiKeyById(ctx, tx, id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE api_keys SET prefix = ?, key_hash = ?, last_used_at = NULL WHERE id = ? AND revoked_at IS NULL", prefix, hashApiKey(key), id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return ApiKey{}, err
+	} else if rowsAffected == 0 {
+		return ApiKey{}, NewProblem(http.StatusNotFound, "api_key.not_found", fmt.Sprintf("API key with id %d not found or revoked", id))
+	}
+	apiKey, err := selectApiKeyById(ctx, tx, id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	err = recordAudit(ctx, tx, actor, "apikey", fmt.Sprintf("%d", id), "rotate", before, apiKey)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	apiKey.Key = key
+
+	return apiKey, tx.Commit()
+}
+
+// RevokeApiKey stops the key with id from working, and records the change by
+// actor in the audit log. Revoked keys are kept, to know who they were in the
+// audit log.
+func RevokeApiKey(ctx context.Context, dbConn *sql.DB, id int, actor string) error {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := selectApiKeyById(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return NewProblem(http.StatusNotFound, "api_key.not_found", fmt.Sprintf("API key with id %d not found or revoked", id))
+	}
+	after, err := selectApiKeyById(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(ctx, tx, actor, "apikey", fmt.Sprintf("%d", id), "revoke", before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AuthenticateApiKey returns the key that was given, unless it is unknown or
+// revoked.
+func AuthenticateApiKey(ctx context.Context, dbConn *sql.DB, key string) (ApiKey, error) {
+	if len(key) <= apiKeyPrefixLength {
+		return ApiKey{}, errInvalidApiKey
+	}
+	keys, err := selectApiKeysWhere(ctx, dbConn, "prefix = ? AND revoked_at IS NULL", key[:apiKeyPrefixLength])
+	if err != nil {
+		return ApiKey{}, err
+	} else if len(keys) == 0 || subtle.ConstantTimeCompare([]byte(keys[0].keyHash), []byte(hashApiKey(key))) != 1 {
+		return ApiKey{}, errInvalidApiKey
+	}
+	return keys[0], nil
+}
+
+// TouchApiKey records that the key with id was used at now, unless it already
+// was less than a minute before.
+func TouchApiKey(ctx context.Context, dbConn *sql.DB, id int, now time.Time) error {
+	_, err := dbConn.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)", now.UTC(), id, now.UTC().Add(-apiKeyTouchInterval))
+	return err
+}
+
+func selectApiKeysWhere(ctx context.Context, dbConn querier, condition string, args ...any) ([]ApiKey, error) {
+	defer observeQuery("api_keys", time.Now())
+	keys := []ApiKey{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key ApiKey
+		var scopes string
+
+		err = rows.Scan(&key.Id, &key.Name, &key.Prefix, &key.keyHash, &scopes, &key.RateLimit, &key.CreatedBy, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
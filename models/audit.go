@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+func CreateAuditEventsTable(dbConn *sql.DB) (sql.Result, error) {
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS audit_events (id INTEGER PRIMARY KEY AUTOINCREMENT, actor TEXT, created_at DATETIME, entity TEXT, entity_id TEXT, action TEXT, diff TEXT)")
+	if err != nil {
+		return nil, err
+	}
+	// The audit log is append-only, reject any attempt to rewrite it
+	_, err = dbConn.Exec("CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec("CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END")
+
+	return res, err
+}
+
+func SelectAuditEvents(ctx context.Context, dbConn *sql.DB, entity string, entityId string) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT id, actor, created_at, entity, entity_id, action, diff FROM audit_events WHERE (? = '' OR entity = ?) AND (? = '' OR entity_id = ?) ORDER BY id", entity, entity, entityId, entityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		var diff string
+
+		err = rows.Scan(&event.Id, &event.Actor, &event.CreatedAt, &event.Entity, &event.EntityId, &event.Action, &diff)
+		if err != nil {
+			return nil, err
+		}
+		event.Diff = json.RawMessage(diff)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+type AuditEvent struct {
+	Id        int             `json:"id"`
+	Actor     string          `json:"actor"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Entity    string          `json:"entity"` // player or match
+	EntityId  string          `json:"entityId"`
+	Action    string          `json:"action"`                    // create, update, delete or restore
+	Diff      json.RawMessage `json:"diff" swaggertype:"object"` // changed fields with their old and new values
+}
+
+// NewAuditEvent builds an event for a change of entity from before to after,
+// either of which may be nil when the entity is created or removed.
+func NewAuditEvent(actor string, entity string, entityId string, action string, before any, after any) (AuditEvent, error) {
+	diff, err := diffFields(before, after)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+
+	return AuditEvent{Actor: actor, CreatedAt: time.Now().UTC(), Entity: entity, EntityId: entityId, Action: action, Diff: diff}, nil
+}
+
+func (e AuditEvent) Create(ctx context.Context, dbConn querier) (sql.Result, error) {
+	return dbConn.ExecContext(ctx,
+		"INSERT INTO audit_events (actor, created_at, entity, entity_id, action, diff) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Actor, e.CreatedAt, e.Entity, e.EntityId, e.Action, string(e.Diff),
+	)
+}
+
+// recordAudit writes the audit event of a change by actor in the transaction
+// of the change, so no change is saved without it.
+func recordAudit(ctx context.Context, tx querier, actor string, entity string, entityId string, action string, before any, after any) error {
+	event, err := NewAuditEvent(actor, entity, entityId, action, before, after)
+	if err != nil {
+		return err
+	}
+	_, err = event.Create(ctx, tx)
+
+	return err
+}
+
+type fieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// diffFields compares the JSON representation of before and after and keeps
+// only the fields whose value changed.
+func diffFields(before any, after any) (json.RawMessage, error) {
+	var err error
+	var oldFields map[string]any
+	var newFields map[string]any
+	var changes = map[string]fieldChange{}
+
+	oldFields, err = jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err = jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range oldFields {
+		if !reflect.DeepEqual(value, newFields[name]) {
+			changes[name] = fieldChange{Old: value, New: newFields[name]}
+		}
+	}
+	for name, value := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			changes[name] = fieldChange{Old: nil, New: value}
+		}
+	}
+
+	return json.Marshal(changes)
+}
+
+func jsonFields(value any) (map[string]any, error) {
+	var fields map[string]any
+
+	if value == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &fields)
+
+	return fields, err
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Claim statuses. A claim is pending until an organiser approves or rejects
+// it.
+const (
+	ClaimPending  = "pending"
+	ClaimApproved = "approved"
+	ClaimRejected = "rejected"
+)
+
+const claimColumns = "id, user_id, player_id, status, created_at, decided_at, decided_by"
+
+func CreatePlayerClaimsTable(dbConn *sql.DB) (sql.Result, error) {
+	return dbConn.Exec("CREATE TABLE IF NOT EXISTS player_claims (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, player_id INTEGER, status TEXT, created_at DATETIME, decided_at DATETIME, decided_by TEXT)")
+}
+
+// PlayerClaim is a user asking to be linked to a player, so it owns its
+// profile from then on.
+type PlayerClaim struct {
+	Id        int        `json:"id"`
+	UserId    int        `json:"userId"`
+	PlayerId  int        `json:"playerId"`
+	Status    string     `json:"status"` // pending, approved or rejected
+	CreatedAt time.Time  `json:"createdAt"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+	DecidedBy string     `json:"decidedBy,omitempty"`
+}
+
+// CreatePlayerClaim asks for the user with userId to be linked to the player
+// with playerId, as actor in the audit log. Users that already are a player,
+// or wait for a decision, can't claim another one, and nobody can claim a
+// player someone already is.
+func CreatePlayerClaim(ctx context.Context, dbConn *sql.DB, userId int, playerId int, actor string) (PlayerClaim, error) {
+	claim := PlayerClaim{UserId: userId, PlayerId: playerId, Status: ClaimPending, CreatedAt: time.Now().UTC()}
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return claim, err
+	}
+	defer tx.Rollback()
+
+	_, err = SelectPlayerById(ctx, tx, fmt.Sprintf("%d", playerId))
+	if err != nil {
+		return claim, err
+	}
+	err = checkClaimable(ctx, tx, userId, playerId)
+	if err != nil {
+		return claim, err
+	}
+	claims, err := selectPlayerClaimsWhere(ctx, tx, "user_id = ? AND status = ?", userId, ClaimPending)
+	if err != nil {
+		return claim, err
+	} else if len(claims) > 0 {
+		return claim, NewProblem(http.StatusConflict, "claim.pending", "You already have a claim waiting for a decision")
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO player_claims (user_id, player_id, status, created_at, decided_by) VALUES (?, ?, ?, ?, '')", claim.UserId, claim.PlayerId, claim.Status, claim.CreatedAt)
+	if err != nil {
+		return claim, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return claim, err
+	}
+	claim.Id = int(id)
+	err = recordAudit(ctx, tx, actor, "claim", fmt.Sprintf("%d", claim.Id), "create", nil, claim)
+	if err != nil {
+		return claim, err
+	}
+
+	return claim, tx.Commit()
+}
+
+// checkClaimable tells why the user can't be linked to the player, if it
+// can't.
+func checkClaimable(ctx context.Context, dbConn querier, userId int, playerId int) error {
+	users, err := selectUsersWhere(ctx, dbConn, "id = ?", userId)
+	if err != nil {
+		return err
+	} else if len(users) == 0 {
+		return NewProblem(http.StatusNotFound, "user.not_found", fmt.Sprintf("User with id %d not found", userId))
+	} else if users[0].PlayerId != nil {
+		return NewProblem(http.StatusConflict, "claim.already_linked", "You are already linked to a player")
+	}
+	owners, err := selectUsersWhere(ctx, dbConn, "player_id = ?", playerId)
+	if err != nil {
+		return err
+	} else if len(owners) > 0 {
+		return NewProblem(http.StatusConflict, "claim.player_taken", "Another user is already linked to this player")
+	}
+	return nil
+}
+
+// SelectPlayerClaims returns the claims with status, all of them when status
+// is empty.
+func SelectPlayerClaims(ctx context.Context, dbConn *sql.DB, status string) ([]PlayerClaim, error) {
+	return selectPlayerClaimsWhere(ctx, dbConn, "(? = '' OR status = ?) ORDER BY id", status, status)
+}
+
+// DecidePlayerClaim approves or rejects a pending claim on behalf of
+// decidedBy, who the decision is recorded as in the audit log. Approving links
+// the user to the player and rejects the other claims on the same player.
+func DecidePlayerClaim(ctx context.Context, dbConn *sql.DB, id int, approve bool, decidedBy string) (PlayerClaim, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return PlayerClaim{}, err
+	}
+	defer tx.Rollback()
+
+	claims, err := selectPlayerClaimsWhere(ctx, tx, "id = ? AND status = ?", id, ClaimPending)
+	if err != nil {
+		return PlayerClaim{}, err
+	} else if len(claims) == 0 {
+		return PlayerClaim{}, NewProblem(http.StatusNotFound, "claim.not_found", fmt.Sprintf("Pending claim with id %d not found", id))
+	}
+	claim := claims[0]
+	now := time.Now().UTC()
+	claim.Status = ClaimRejected
+	if approve {
+		claim.Status = ClaimApproved
+		err = checkClaimable(ctx, tx, claim.UserId, claim.PlayerId)
+		if err != nil {
+			return PlayerClaim{}, err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE users SET player_id = ? WHERE id = ?", claim.PlayerId, claim.UserId)
+		if err != nil {
+			return PlayerClaim{}, err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE player_claims SET status = ?, decided_at = ?, decided_by = ? WHERE player_id = ? AND status = ? AND id != ?", ClaimRejected, now, decidedBy, claim.PlayerId, ClaimPending, claim.Id)
+		if err != nil {
+			return PlayerClaim{}, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE player_claims SET status = ?, decided_at = ?, decided_by = ? WHERE id = ?", claim.Status, now, decidedBy, claim.Id)
+	if err != nil {
+		return PlayerClaim{}, err
+	}
+	claim.DecidedAt = &now
+	claim.DecidedBy = decidedBy
+	action := "reject"
+	if approve {
+		action = "approve"
+	}
+	err = recordAudit(ctx, tx, decidedBy, "claim", fmt.Sprintf("%d", claim.Id), action, nil, claim)
+	if err != nil {
+		return PlayerClaim{}, err
+	}
+
+	return claim, tx.Commit()
+}
+
+func selectPlayerClaimsWhere(ctx context.Context, dbConn querier, condition string, args ...any) ([]PlayerClaim, error) {
+	defer observeQuery("player_claims", time.Now())
+	claims := []PlayerClaim{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT "+claimColumns+" FROM player_claims WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var claim PlayerClaim
+
+		err = rows.Scan(&claim.Id, &claim.UserId, &claim.PlayerId, &claim.Status, &claim.CreatedAt, &claim.DecidedAt, &claim.DecidedBy)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+
+	return claims, rows.Err()
+}
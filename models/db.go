@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so the same helpers can be
+// used inside and outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// addColumnIfNotExists lets tables created by an older version of the service
+// pick up columns added since.
+func addColumnIfNotExists(dbConn *sql.DB, table string, column string, definition string) error {
+	exists, err := hasColumn(dbConn, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = dbConn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// hasColumn tells whether table has column, false when there is no table.
+func hasColumn(dbConn *sql.DB, table string, column string) (bool, error) {
+	rows, err := dbConn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+		if err != nil {
+			return false, err
+		} else if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// deletedFilter returns the condition that hides soft deleted rows, or one that
+// matches every row when they were asked for.
+func deletedFilter(includeDeleted bool) string {
+	if includeDeleted {
+		return "1 = 1"
+	}
+	return "deleted_at IS NULL"
+}
+
+// Migrate creates the tables of the service, and adds the columns added since
+// to the tables of an older version. It may run again, on a migrated database
+// it changes nothing.
+func Migrate(dbConn *sql.DB) error {
+	migrations := []struct {
+		table  string
+		create func(*sql.DB) (sql.Result, error)
+	}{
+		{"players", CreatePlayersTable},
+		{"matches", CreateMatchesTable},
+		{"match events", CreateMatchEventsTable},
+		{"audit events", CreateAuditEventsTable},
+		{"webhooks", CreateWebhooksTable},
+		{"idempotency keys", CreateIdempotencyKeysTable},
+		{"users", CreateUsersTable},
+		{"player claims", CreatePlayerClaimsTable},
+		{"API keys", CreateApiKeysTable},
+	}
+	for _, migration := range migrations {
+		_, err := migration.create(dbConn)
+		if err != nil {
+			return fmt.Errorf("could not create %s table: %w", migration.table, err)
+		}
+	}
+	return nil
+}
+
+// schema lists the tables Migrate creates, with the columns it adds to older
+// tables. Keep it in line with the Create*Table functions.
+var schema = map[string][]string{
+	"players":            {"deleted_at", "version"},
+	"matches":            {"awarded_points", "deleted_at", "version"},
+	"match_events":       nil,
+	"audit_events":       nil,
+	"webhooks":           nil,
+	"webhook_deliveries": nil,
+	"idempotency_keys":   {"principal"},
+	"users":              {"role", "player_id"},
+	"player_claims":      nil,
+	"api_keys":           nil,
+}
+
+// PendingMigrations returns the tables, and the table.column, that Migrate has
+// yet to create, sorted.
+func PendingMigrations(ctx context.Context, dbConn *sql.DB) ([]string, error) {
+	var pending []string
+
+	for table, columns := range schema {
+		existing := map[string]bool{}
+		rows, err := dbConn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			existing[name] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(existing) == 0 {
+			pending = append(pending, table)
+			continue
+		}
+		for _, column := range columns {
+			if !existing[column] {
+				pending = append(pending, table+"."+column)
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
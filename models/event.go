@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	MatchScheduled   = "MatchScheduled"
+	MatchRescheduled = "MatchRescheduled"
+	ResultRecorded   = "ResultRecorded"
+	ResultCorrected  = "ResultCorrected"
+	MatchCancelled   = "MatchCancelled"
+	MatchRestored    = "MatchRestored"
+)
+
+func CreateMatchEventsTable(dbConn *sql.DB) (sql.Result, error) {
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS match_events (id INTEGER PRIMARY KEY AUTOINCREMENT, match_id INTEGER, type TEXT, occurred_at DATETIME, player1_id INTEGER, player2_id INTEGER, start_time DATETIME, end_time DATETIME, table_number INTEGER, winner_id INTEGER)")
+	if err != nil {
+		return nil, err
+	}
+	// Events are the source of truth for results, they are never rewritten
+	_, err = dbConn.Exec("CREATE TRIGGER IF NOT EXISTS match_events_no_update BEFORE UPDATE ON match_events BEGIN SELECT RAISE(ABORT, 'match events are immutable'); END")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec("CREATE TRIGGER IF NOT EXISTS match_events_no_delete BEFORE DELETE ON match_events BEGIN SELECT RAISE(ABORT, 'match events are immutable'); END")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec("CREATE INDEX IF NOT EXISTS match_events_match_id ON match_events (match_id)")
+	if err != nil {
+		return nil, err
+	}
+
+	return res, backfillMatchEvents(dbConn)
+}
+
+// backfillMatchEvents derives a history for matches recorded before events
+// existed, so the projections can be rebuilt from the first match on.
+func backfillMatchEvents(dbConn *sql.DB) error {
+	var count int
+	ctx := context.Background() // part of the migrations, not of a request
+
+	err := dbConn.QueryRow("SELECT COUNT(*) FROM match_events").Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	matches, err := selectMatchesWhere(ctx, dbConn, "SELECT "+matchColumns+" FROM matches ORDER BY id")
+	if err != nil {
+		return err
+	}
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, match := range matches {
+		_, err = NewMatchEvent(MatchScheduled, match).Create(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if match.WinnerId != 0 {
+			_, err = NewMatchEvent(ResultRecorded, match).Create(ctx, tx)
+			if err != nil {
+				return err
+			}
+		}
+		if match.DeletedAt != nil {
+			_, err = NewMatchEvent(MatchCancelled, match).Create(ctx, tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func SelectMatchEvents(ctx context.Context, dbConn querier) ([]MatchEvent, error) {
+	return selectMatchEventsWhere(ctx, dbConn, "1 = 1")
+}
+
+// SelectMatchEventsAfter returns the events of a match that happened after the
+// event with id afterId, for clients catching up on what they missed.
+func SelectMatchEventsAfter(ctx context.Context, dbConn querier, matchId int, afterId int) ([]MatchEvent, error) {
+	return selectMatchEventsWhere(ctx, dbConn, "match_id = ? AND id > ?", matchId, afterId)
+}
+
+func selectMatchEventsWhere(ctx context.Context, dbConn querier, condition string, args ...any) ([]MatchEvent, error) {
+	defer observeQuery("match_events", time.Now())
+	events := []MatchEvent{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT id, match_id, type, occurred_at, player1_id, player2_id, start_time, end_time, table_number, winner_id FROM match_events WHERE "+condition+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event MatchEvent
+
+		err = rows.Scan(&event.Id, &event.MatchId, &event.Type, &event.OccurredAt, &event.Player1id, &event.Player2id, &event.StartTime, &event.EndTime, &event.TableNumber, &event.WinnerId)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// MatchEvent is an immutable fact about a match. Each event carries the state
+// of the match right after it happened.
+type MatchEvent struct {
+	Id          int       `json:"id"`
+	MatchId     int       `json:"matchId"`
+	Type        string    `json:"type"`
+	OccurredAt  time.Time `json:"occurredAt"`
+	Player1id   int       `json:"player1id"`
+	Player2id   int       `json:"player2id"`
+	StartTime   time.Time `json:"startTime"`
+	EndTime     time.Time `json:"endTime"`
+	TableNumber int       `json:"tableNumber"`
+	WinnerId    int       `json:"winnerId"`
+}
+
+func NewMatchEvent(eventType string, match Match) MatchEvent {
+	return MatchEvent{
+		MatchId:     match.Id,
+		Type:        eventType,
+		OccurredAt:  time.Now().UTC(),
+		Player1id:   match.Player1id,
+		Player2id:   match.Player2id,
+		StartTime:   match.StartTime,
+		EndTime:     match.EndTime,
+		TableNumber: match.TableNumber,
+		WinnerId:    match.WinnerId,
+	}
+}
+
+func (e MatchEvent) Create(ctx context.Context, dbConn querier) (sql.Result, error) {
+	return dbConn.ExecContext(ctx,
+		"INSERT INTO match_events (match_id, type, occurred_at, player1_id, player2_id, start_time, end_time, table_number, winner_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.MatchId, e.Type, e.OccurredAt, e.Player1id, e.Player2id, e.StartTime, e.EndTime, e.TableNumber, e.WinnerId,
+	)
+}
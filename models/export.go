@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ExportedMatch is a match with the names of its players, as exported.
+type ExportedMatch struct {
+	Match
+	Player1Name string `json:"player1Name"`
+	Player2Name string `json:"player2Name"`
+	WinnerName  string `json:"winnerName"`
+}
+
+// ExportedStanding is a standing with the name of its player, as exported.
+type ExportedStanding struct {
+	Standing
+	PlayerName string `json:"playerName"`
+}
+
+// exportPageSize is how many rows an export reads at once. Each page is read
+// in full before fn sees it, so no query stays open while a slow client takes
+// the export, which would hold up the writes to the database.
+const exportPageSize = MaxPageLimit
+
+// EachPlayer calls fn with every player the filter selects, in the order of
+// sort. Players are read a page at a time, so any number of them can be
+// exported.
+func EachPlayer(ctx context.Context, dbConn *sql.DB, filter PlayerFilter, sort string, fn func(Player) error) error {
+	page := Page{Sort: sort, Limit: exportPageSize}
+	for {
+		players, err := SelectPlayers(ctx, dbConn, filter, page)
+		if err != nil {
+			return err
+		}
+		for _, player := range players {
+			err = fn(player)
+			if err != nil {
+				return err
+			}
+		}
+		if len(players) < exportPageSize {
+			return nil
+		}
+		page.Cursor = page.NextCursor(players[len(players)-1])
+	}
+}
+
+// EachMatch calls fn with every match the filter selects, along with the names
+// of its players, in the order of sort. Matches are read a page at a time, so
+// any number of them can be exported.
+func EachMatch(ctx context.Context, dbConn *sql.DB, filter MatchFilter, sort string, fn func(ExportedMatch) error) error {
+	page := Page{Sort: sort, Limit: exportPageSize}
+	for {
+		matches, err := selectExportedMatches(ctx, dbConn, filter, page)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			err = fn(match)
+			if err != nil {
+				return err
+			}
+		}
+		if len(matches) < exportPageSize {
+			return nil
+		}
+		page.Cursor = page.NextCursor(matches[len(matches)-1])
+	}
+}
+
+func selectExportedMatches(ctx context.Context, dbConn *sql.DB, filter MatchFilter, page Page) ([]ExportedMatch, error) {
+	defer observeQuery("matches", time.Now())
+	conditions, args, err := filter.conditions()
+	if err != nil {
+		return nil, err
+	}
+	names := ", COALESCE((SELECT name FROM players WHERE id = matches.player1_id), ''), COALESCE((SELECT name FROM players WHERE id = matches.player2_id), ''), COALESCE((SELECT name FROM players WHERE id = matches.winner_id), '')"
+	query, args, err := page.selectPage("matches", matchColumns+names, matchSortColumns, conditions, args)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	matches := []ExportedMatch{}
+	for rows.Next() {
+		var exported ExportedMatch
+
+		exported.Match, err = scanMatch(rows, &exported.Player1Name, &exported.Player2Name, &exported.WinnerName)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, exported)
+	}
+
+	return matches, rows.Err()
+}
+
+// ExportStandings returns the standings along with the names of the players.
+func ExportStandings(ctx context.Context, dbConn *sql.DB, rule ScoringRule) ([]ExportedStanding, error) {
+	names := map[int]string{}
+	projection, err := ReplayMatchEvents(ctx, dbConn, rule)
+	if err != nil {
+		return nil, err
+	}
+	err = EachPlayer(ctx, dbConn, PlayerFilter{IncludeDeleted: true}, "", func(player Player) error {
+		names[player.Id] = player.Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	standings := []ExportedStanding{}
+	for _, standing := range projection.Standings() {
+		standings = append(standings, ExportedStanding{Standing: standing, PlayerName: names[standing.PlayerId]})
+	}
+
+	return standings, nil
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+func CreateIdempotencyKeysTable(dbConn *sql.DB) (sql.Result, error) {
+	// Keys used to be shared by every caller. The primary key can't change in
+	// place, and the responses are only kept for retries, so older tables go.
+	scoped, err := hasColumn(dbConn, "idempotency_keys", "principal")
+	if err != nil {
+		return nil, err
+	} else if !scoped {
+		_, err = dbConn.Exec("DROP TABLE IF EXISTS idempotency_keys")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dbConn.Exec("CREATE TABLE IF NOT EXISTS idempotency_keys (key TEXT NOT NULL, principal TEXT NOT NULL, route TEXT NOT NULL, request_hash TEXT, status INTEGER, content_type TEXT, body BLOB, created_at DATETIME, PRIMARY KEY (key, principal, route))")
+}
+
+// IdempotentResponse is the first response given to a request with an
+// Idempotency-Key, replayed to the retries of that request by the same
+// principal. Status is 0 while the first request is still being handled.
+type IdempotentResponse struct {
+	Key         string
+	Principal   string // who made the request, see principal.id
+	Route       string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// ReserveIdempotencyKey claims key for a request by principal to route whose
+// body hashes to requestHash. It returns true when the key was free, otherwise
+// the response already stored for it. Keys reserved before cutoff have expired
+// and are free again, even if they haven't been purged yet.
+func ReserveIdempotencyKey(ctx context.Context, dbConn *sql.DB, key string, principal string, route string, requestHash string, cutoff time.Time) (IdempotentResponse, bool, error) {
+	var response IdempotentResponse
+
+	_, err := dbConn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = ? AND principal = ? AND route = ? AND created_at < ?", key, principal, route, cutoff.UTC())
+	if err != nil {
+		return response, false, err
+	}
+	res, err := dbConn.ExecContext(ctx,
+		"INSERT OR IGNORE INTO idempotency_keys (key, principal, route, request_hash, status, content_type, body, created_at) VALUES (?, ?, ?, ?, 0, '', NULL, ?)",
+		key, principal, route, requestHash, time.Now().UTC(),
+	)
+	if err != nil {
+		return response, false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 1 {
+		return response, err == nil, err
+	}
+
+	err = dbConn.QueryRowContext(ctx,
+		"SELECT key, principal, route, request_hash, status, content_type, COALESCE(body, ''), created_at FROM idempotency_keys WHERE key = ? AND principal = ? AND route = ?",
+		key, principal, route,
+	).Scan(&response.Key, &response.Principal, &response.Route, &response.RequestHash, &response.Status, &response.ContentType, &response.Body, &response.CreatedAt)
+
+	return response, false, err
+}
+
+// SaveIdempotentResponse stores the response to the request that reserved
+// its key.
+func SaveIdempotentResponse(ctx context.Context, dbConn *sql.DB, response IdempotentResponse) (sql.Result, error) {
+	return dbConn.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE key = ? AND principal = ? AND route = ?",
+		response.Status, response.ContentType, response.Body, response.Key, response.Principal, response.Route,
+	)
+}
+
+// ReleaseIdempotencyKey frees a reserved key, so the request can be retried.
+func ReleaseIdempotencyKey(ctx context.Context, dbConn *sql.DB, key string, principal string, route string) (sql.Result, error) {
+	return dbConn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = ? AND principal = ? AND route = ?", key, principal, route)
+}
+
+func PurgeIdempotencyKeysBefore(ctx context.Context, dbConn *sql.DB, cutoff time.Time) (sql.Result, error) {
+	return dbConn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", cutoff.UTC())
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	ImportCreated = "created"
+	ImportFailed  = "failed"
+	ImportSkipped = "skipped" // valid, but not created because another row failed
+)
+
+// ImportRow reports what became of one row of an import, rows are numbered
+// from 1 in the order they were sent.
+type ImportRow struct {
+	Row    int      `json:"row"`
+	Status string   `json:"status"` // created, failed or skipped
+	Id     int      `json:"id,omitempty"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// ImportReport sums up an import row by row.
+type ImportReport struct {
+	Created int         `json:"created"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+func NewImportReport(rows []ImportRow) ImportReport {
+	report := ImportReport{Rows: rows}
+	for _, row := range rows {
+		if row.Status == ImportCreated {
+			report.Created++
+		} else if row.Status == ImportFailed {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// Fail marks the row as failed because of err. Errors that aren't problems
+// are reported as invalid rows.
+func (r *ImportRow) Fail(err error) {
+	var problem Problem
+	if !errors.As(err, &problem) {
+		problem = NewProblem(http.StatusBadRequest, "import.invalid_row", err.Error())
+	}
+	r.Status = ImportFailed
+	r.Error = &problem
+}
+
+// ImportPlayers creates the players of the rows that haven't failed yet, like
+// CreatePlayer. players[i] is the player of rows[i], and is replaced by the
+// player as saved.
+func ImportPlayers(ctx context.Context, dbConn *sql.DB, players []Player, rows []ImportRow, atomic bool, pictureUrl func(id int, name string) string, actor string) error {
+	return importRows(ctx, dbConn, rows, atomic, func(tx querier, i int) (int, error) {
+		player, err := createPlayer(ctx, tx, players[i], pictureUrl, actor)
+		if err != nil {
+			return 0, err
+		}
+		players[i] = player
+		return player.Id, nil
+	})
+}
+
+// ImportMatches creates the matches of the rows that haven't failed yet, with
+// the same checks as a single match. matches[i] is the match of rows[i].
+func ImportMatches(ctx context.Context, dbConn *sql.DB, matches []Match, rows []ImportRow, atomic bool, actor string) error {
+	err := importRows(ctx, dbConn, rows, atomic, func(tx querier, i int) (int, error) {
+		_, err := matches[i].create(ctx, tx, actor)
+		return matches[i].Id, err
+	})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Status == ImportCreated {
+			matchesCreated.Inc()
+		}
+	}
+
+	return nil
+}
+
+// importRows runs create for every row that hasn't failed, in a single
+// transaction. Each row gets a savepoint, so a failed row leaves no trace. An
+// atomic import creates nothing when any row failed, otherwise the failed rows
+// are left out.
+func importRows(ctx context.Context, dbConn *sql.DB, rows []ImportRow, atomic bool, create func(tx querier, i int) (int, error)) error {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for i := range rows {
+		if rows[i].Status == ImportFailed {
+			failed = true
+			continue
+		}
+		savepoint := fmt.Sprintf("row_%d", i)
+		_, err = tx.ExecContext(ctx, "SAVEPOINT "+savepoint)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var problem Problem
+		id, err := create(tx, i)
+		if err != nil && !errors.As(err, &problem) {
+			tx.Rollback()
+			return err
+		} else if err != nil {
+			failed = true
+			rows[i].Fail(err)
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO "+savepoint)
+		} else {
+			rows[i].Status = ImportCreated
+			rows[i].Id = id
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "RELEASE "+savepoint)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if atomic && failed {
+		for i := range rows {
+			if rows[i].Status == ImportCreated {
+				rows[i].Status = ImportSkipped
+				rows[i].Id = 0
+			}
+		}
+		return tx.Rollback()
+	}
+
+	return tx.Commit()
+}
@@ -1,77 +1,327 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
+const matchColumns = "id, player1_id, player2_id, start_time, end_time, COALESCE(winner_id, 0), table_number, awarded_points, deleted_at, version"
+
 func CreateMatchesTable(dbConn *sql.DB) (sql.Result, error) {
-	return dbConn.Exec("CREATE TABLE IF NOT EXISTS matches (id INTEGER PRIMARY KEY AUTOINCREMENT, player1_id INTEGER, player2_id INTEGER, start_time DATETIME, end_time DATETIME, winner_id INTEGER, table_number INTEGER)")
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS matches (id INTEGER PRIMARY KEY AUTOINCREMENT, player1_id INTEGER, player2_id INTEGER, start_time DATETIME, end_time DATETIME, winner_id INTEGER, table_number INTEGER, awarded_points INTEGER DEFAULT 0, deleted_at DATETIME, version INTEGER DEFAULT 1)")
+	if err != nil {
+		return nil, err
+	}
+	err = addColumnIfNotExists(dbConn, "matches", "awarded_points", "INTEGER DEFAULT 0")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumnIfNotExists(dbConn, "matches", "deleted_at", "DATETIME")
+	if err != nil {
+		return nil, err
+	}
+	err = addColumnIfNotExists(dbConn, "matches", "version", "INTEGER DEFAULT 1")
+	if err != nil {
+		return nil, err
+	}
+	// Recording a result looks up whether its players have other results
+	_, err = dbConn.Exec("CREATE INDEX IF NOT EXISTS matches_player1_id ON matches (player1_id)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec("CREATE INDEX IF NOT EXISTS matches_player2_id ON matches (player2_id)")
+
+	return res, err
 }
 
-func SelectAllMatches(dbConn *sql.DB) ([]Match, error) {
-	return selectMatchesWhere(dbConn, "SELECT * FROM matches")
+func SelectAllMatches(ctx context.Context, dbConn *sql.DB, includeDeleted bool) ([]Match, error) {
+	return selectMatchesWhere(ctx, dbConn, "SELECT "+matchColumns+" FROM matches WHERE "+deletedFilter(includeDeleted))
 }
 
-func SelectMatchesByStatus(dbConn *sql.DB, status string) ([]Match, error) {
+func statusCondition(status string) (string, error) {
 	if status == "upcoming" {
-		return selectMatchesWhere(dbConn, "SELECT * FROM matches WHERE start_time >= '"+time.Now().Format("2006-01-02 15:04:05")+"'")
+		return "start_time >= '" + time.Now().Format("2006-01-02 15:04:05") + "'", nil
 	} else if status == "ongoing" {
-		return selectMatchesWhere(dbConn, "SELECT * FROM matches WHERE '"+time.Now().Format("2006-01-02 15:04:05")+"' BETWEEN start_time AND end_time")
+		return "'" + time.Now().Format("2006-01-02 15:04:05") + "' BETWEEN start_time AND end_time", nil
 	} else if status == "finished" {
-		return selectMatchesWhere(dbConn, "SELECT * FROM matches WHERE end_time < '"+time.Now().Format("2006-01-02 15:04:05")+"'")
+		return "end_time < '" + time.Now().Format("2006-01-02 15:04:05") + "'", nil
 	} else {
-		return nil, MatchError{StatusCode: http.StatusBadRequest, Err: "Invalid status"}
+		return "", NewProblem(http.StatusBadRequest, "match.invalid_status", "Status must be upcoming, ongoing or finished")
+	}
+}
+
+// matchSortColumns are the fields matches can be sorted by.
+var matchSortColumns = map[string]string{
+	"id":          "id",
+	"startTime":   "start_time",
+	"tableNumber": "table_number",
+}
+
+// MatchFilter narrows the matches returned by SelectMatches, zero values
+// don't filter.
+type MatchFilter struct {
+	Status         string
+	PlayerId       int
+	TableNumber    *int
+	WinnerId       int
+	From           time.Time
+	To             time.Time
+	IncludeDeleted bool
+}
+
+func (f MatchFilter) conditions() ([]string, []any, error) {
+	var conditions = []string{deletedFilter(f.IncludeDeleted)}
+	var args []any
+
+	if f.Status != "" {
+		condition, err := statusCondition(f.Status)
+		if err != nil {
+			return nil, nil, err
+		}
+		conditions = append(conditions, condition)
 	}
+	if f.PlayerId != 0 {
+		conditions = append(conditions, "(player1_id = ? OR player2_id = ?)")
+		args = append(args, f.PlayerId, f.PlayerId)
+	}
+	if f.TableNumber != nil {
+		conditions = append(conditions, "table_number = ?")
+		args = append(args, *f.TableNumber)
+	}
+	if f.WinnerId != 0 {
+		conditions = append(conditions, "winner_id = ?")
+		args = append(args, f.WinnerId)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "start_time >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "start_time <= ?")
+		args = append(args, f.To)
+	}
+
+	return conditions, args, nil
 }
 
-func SelectMatchById(dbConn *sql.DB, id string) (Match, error) {
-	matches, err := selectMatchesWhere(dbConn, "SELECT * FROM matches WHERE id = "+id)
+func SelectMatches(ctx context.Context, dbConn *sql.DB, filter MatchFilter, page Page) ([]Match, error) {
+	conditions, args, err := filter.conditions()
+	if err != nil {
+		return nil, err
+	}
+	query, args, err := page.selectPage("matches", matchColumns, matchSortColumns, conditions, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectMatchesWhere(ctx, dbConn, query, args...)
+}
+
+// SelectMatchesByPlayerIds returns the matches played by any of the given
+// players in a single query, by start time.
+func SelectMatchesByPlayerIds(ctx context.Context, dbConn *sql.DB, ids []int) ([]Match, error) {
+	if len(ids) == 0 {
+		return []Match{}, nil
+	}
+	args := make([]any, 0, 2*len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, args...)
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+	return selectMatchesWhere(ctx, dbConn, "SELECT "+matchColumns+" FROM matches WHERE (player1_id IN "+in+" OR player2_id IN "+in+") AND deleted_at IS NULL ORDER BY start_time, id", args...)
+}
+
+func SelectMatchById(ctx context.Context, dbConn querier, id string) (Match, error) {
+	matches, err := selectMatchesWhere(ctx, dbConn, "SELECT "+matchColumns+" FROM matches WHERE id = ? AND deleted_at IS NULL", id)
 	if err != nil {
 		return Match{}, err
 	} else if len(matches) == 0 {
-		return Match{}, MatchError{http.StatusNotFound, fmt.Sprintf("Match with id %s not found", id)}
+		return Match{}, NewProblem(http.StatusNotFound, "match.not_found", fmt.Sprintf("Match with id %s not found", id))
 	}
 
 	return matches[0], nil
 }
 
-func selectMatchesWhere(dbConn *sql.DB, query string) ([]Match, error) {
+func selectMatchesWhere(ctx context.Context, dbConn querier, query string, args ...any) ([]Match, error) {
+	defer observeQuery("matches", time.Now())
 	matches := []Match{}
-	rows, err := dbConn.Query(query)
+	rows, err := dbConn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var match Match
-
-		rows.Scan(&match.Id, &match.Player1id, &match.Player2id, &match.StartTime, &match.EndTime, &match.WinnerId, &match.TableNumber)
+		match, err := scanMatch(rows)
+		if err != nil {
+			return nil, err
+		}
 		matches = append(matches, match)
 	}
 
-	return matches, nil
+	return matches, rows.Err()
 }
 
-func UpdateMatchById(dbConn *sql.DB, id string, match Match) (sql.Result, error) {
-	return dbConn.Exec("UPDATE matches SET player1_id = ?, player2_id = ?, start_time = ?, end_time = ?, winner_id = ?, table_number = ? WHERE id = ?", match.Player1id, match.Player2id, match.StartTime, match.EndTime, match.WinnerId, match.TableNumber, id)
+// scanMatch reads a row of matchColumns, followed by any extra columns.
+func scanMatch(rows *sql.Rows, extra ...any) (Match, error) {
+	var match Match
+
+	err := rows.Scan(append([]any{&match.Id, &match.Player1id, &match.Player2id, &match.StartTime, &match.EndTime, &match.WinnerId, &match.TableNumber, &match.awardedPoints, &match.DeletedAt, &match.Version}, extra...)...)
+	return match, err
 }
 
-func DeleteMatchById(dbConn *sql.DB, id string) (sql.Result, error) {
-	return dbConn.Exec("DELETE FROM matches WHERE id = ?", id)
+// RecordMatchResult updates the match, if it is still at match.Version, and
+// records what changed in its history and in the audit log, as a change by
+// actor, along with the webhook event of a new result, in a single
+// transaction. Points and rankings are brought up to date from the history, so
+// re-sending the same result never counts it twice and correcting it moves the
+// points to the new winner.
+func RecordMatchResult(ctx context.Context, dbConn *sql.DB, id string, match Match, rule ScoringRule, actor string) error {
+	var old Match
+	var err error
+	var eventType string
+
+	if match.WinnerId != 0 && match.WinnerId != match.Player1id && match.WinnerId != match.Player2id {
+		return NewProblem(http.StatusBadRequest, "match.invalid_winner", "Winner must be one of the match players")
+	}
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err = SelectMatchById(ctx, tx, id)
+	if err != nil {
+		return err
+	} else if match.Version != 0 && match.Version != old.Version {
+		return errMatchModified
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE matches SET player1_id = ?, player2_id = ?, start_time = ?, end_time = ?, winner_id = ?, table_number = ?, version = version + 1 WHERE id = ?", match.Player1id, match.Player2id, match.StartTime, match.EndTime, match.WinnerId, match.TableNumber, id)
+	if err != nil {
+		return err
+	}
+
+	match.Id = old.Id
+	if match.WinnerId != old.WinnerId && old.WinnerId == 0 {
+		eventType = ResultRecorded
+	} else if match.WinnerId != old.WinnerId {
+		eventType = ResultCorrected
+	} else if match.Player1id != old.Player1id || match.Player2id != old.Player2id || !match.StartTime.Equal(old.StartTime) || !match.EndTime.Equal(old.EndTime) || match.TableNumber != old.TableNumber {
+		eventType = MatchRescheduled
+	}
+	if eventType != "" {
+		err = recordMatchEvent(ctx, tx, NewMatchEvent(eventType, match), rule)
+		if err != nil {
+			return err
+		}
+	}
+	after, err := SelectMatchById(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(ctx, tx, actor, "match", id, "update", old, after)
+	if err != nil {
+		return err
+	}
+	recorded := match.WinnerId != 0 && match.WinnerId != old.WinnerId
+	if recorded {
+		err = EnqueueWebhookEvent(ctx, tx, WebhookMatchResultRecorded, after)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if recorded {
+		resultsRecorded.Inc()
+	}
+
+	return nil
 }
 
-type MatchError struct {
-	StatusCode int
-	Err        string
+// DeleteMatchById cancels the match with a soft delete if it is still at
+// version, its result stops counting and it stays restorable until it is
+// purged. The change by actor is recorded in the audit log.
+func DeleteMatchById(ctx context.Context, dbConn *sql.DB, id string, version int, rule ScoringRule, actor string) (sql.Result, error) {
+	res, err := setMatchDeleted(ctx, dbConn, id, MatchCancelled, rule, actor, "UPDATE matches SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)", time.Now().UTC(), id, version, version)
+	if err != nil {
+		return nil, err
+	} else if rowsAffected, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if rowsAffected == 0 {
+		return nil, errMatchModified
+	}
+
+	return res, nil
 }
 
-func (e MatchError) Error() string {
-	return e.Err
+// RestoreMatchById restores the soft deleted match, and records the change by
+// actor in the audit log. No row is affected when the match isn't deleted, and
+// it is a conflict when its table or players have been booked since.
+func RestoreMatchById(ctx context.Context, dbConn *sql.DB, id string, rule ScoringRule, actor string) (sql.Result, error) {
+	return setMatchDeleted(ctx, dbConn, id, MatchRestored, rule, actor, "UPDATE matches SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL", id)
 }
 
+// setMatchDeleted runs query, which deletes or restores the match, and
+// records it in the history of the match as eventType and in the audit log.
+func setMatchDeleted(ctx context.Context, dbConn *sql.DB, id string, eventType string, rule ScoringRule, actor string, query string, args ...any) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := selectMatchesWhere(ctx, tx, "SELECT "+matchColumns+" FROM matches WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	// Its table and players may have been booked since the match was deleted
+	if eventType == MatchRestored && len(before) > 0 && before[0].DeletedAt != nil {
+		err = before[0].checkBookings(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	} else if rowsAffected, err := res.RowsAffected(); err != nil || rowsAffected == 0 {
+		return res, err
+	}
+	matches, err := selectMatchesWhere(ctx, tx, "SELECT "+matchColumns+" FROM matches WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	err = recordMatchEvent(ctx, tx, NewMatchEvent(eventType, matches[0]), rule)
+	if err != nil {
+		return nil, err
+	}
+	if eventType == MatchCancelled {
+		err = recordAudit(ctx, tx, actor, "match", id, "delete", before[0], nil)
+	} else {
+		err = recordAudit(ctx, tx, actor, "match", id, "restore", nil, matches[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit()
+}
+
+func PurgeMatchesDeletedBefore(ctx context.Context, dbConn *sql.DB, cutoff time.Time) (sql.Result, error) {
+	return dbConn.ExecContext(ctx, "DELETE FROM matches WHERE deleted_at < ?", cutoff.UTC())
+}
+
+var errMatchModified = NewProblem(http.StatusPreconditionFailed, "match.modified", "Match was modified, get it again and retry")
+
 type Match struct {
 	Id          int       `json:"id" uri:"id"`
 	Player1id   int       `json:"player1id" binding:"required"`
@@ -80,40 +330,103 @@ type Match struct {
 	EndTime     time.Time `json:"endTime"`
 	WinnerId    int       `json:"winnerId"`
 	TableNumber int       `json:"tableNumber"`
+
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	Version   int        `json:"version"` // incremented on every change, the ETag of the match
+
+	awardedPoints int // points the result is currently worth to the winner
+}
+
+// SortKey returns the id of m and its value of one of matchSortColumns.
+func (m Match) SortKey(field string) (int, any) {
+	switch field {
+	case "startTime":
+		return m.Id, m.StartTime
+	case "tableNumber":
+		return m.Id, m.TableNumber
+	}
+	return m.Id, m.Id
+}
+
+// Create inserts the match and records its creation by actor in the audit
+// log.
+func (m *Match) Create(ctx context.Context, dbConn *sql.DB, actor string) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := m.create(ctx, tx, actor)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	matchesCreated.Inc()
+
+	return res, nil
 }
 
-func (m *Match) Create(dbConn *sql.DB) (sql.Result, error) {
+// create checks that the match can be played and inserts it with its audit
+// and webhook events, it must run in a transaction so no other match can take
+// its table or players meanwhile.
+func (m *Match) create(ctx context.Context, tx querier, actor string) (sql.Result, error) {
 	if m.Player1id == m.Player2id {
-		return nil, MatchError{StatusCode: http.StatusBadRequest, Err: "Player1 and Player2 must be different"}
-	} else if _, err := SelectPlayerById(dbConn, fmt.Sprintf("%d", m.Player1id)); err != nil {
-		return nil, MatchError{StatusCode: http.StatusBadRequest, Err: "Player1 does not exist"}
-	} else if _, err := SelectPlayerById(dbConn, fmt.Sprintf("%d", m.Player2id)); err != nil {
-		return nil, MatchError{StatusCode: http.StatusBadRequest, Err: "Player2 does not exist"}
+		return nil, NewProblem(http.StatusBadRequest, "match.same_players", "Player1 and Player2 must be different")
+	} else if _, err := SelectPlayerById(ctx, tx, fmt.Sprintf("%d", m.Player1id)); err != nil {
+		return nil, NewProblem(http.StatusBadRequest, "match.player1_not_found", "Player1 does not exist")
+	} else if _, err := SelectPlayerById(ctx, tx, fmt.Sprintf("%d", m.Player2id)); err != nil {
+		return nil, NewProblem(http.StatusBadRequest, "match.player2_not_found", "Player2 does not exist")
 	} else if m.EndTime == (time.Time{}) {
 		m.EndTime = m.StartTime.Add(time.Hour)
 	}
-	tx, err := dbConn.Begin()
+	err := m.checkBookings(ctx, tx)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := tx.Query("SELECT * FROM matches WHERE table_number = ? AND ((start_time BETWEEN ? AND ?) OR (end_time BETWEEN ? AND ?))", m.TableNumber, m.StartTime, m.EndTime, m.StartTime, m.EndTime)
+	res, err := tx.ExecContext(ctx, "INSERT INTO matches (player1_id, player2_id, start_time, end_time, table_number) VALUES (?, ?, ?, ?, ?)", m.Player1id, m.Player2id, m.StartTime, m.EndTime, m.TableNumber)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
-	} else if rows.Next() {
-		tx.Rollback()
-		return nil, MatchError{StatusCode: http.StatusConflict, Err: "Table already booked"}
 	}
-	rows, err = tx.Query("SELECT * FROM matches WHERE (player1_id = ? OR player2_id = ?) AND ((start_time BETWEEN ? AND ?) OR (end_time BETWEEN ? AND ?))", m.Player1id, m.Player1id, m.StartTime, m.EndTime, m.StartTime, m.EndTime)
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	m.Id = int(id)
+	_, err = NewMatchEvent(MatchScheduled, *m).Create(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = recordAudit(ctx, tx, actor, "match", fmt.Sprintf("%d", m.Id), "create", nil, *m)
+	if err != nil {
+		return nil, err
+	}
+	err = EnqueueWebhookEvent(ctx, tx, WebhookMatchScheduled, *m)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
-	} else if rows.Next() {
-		tx.Rollback()
-		return nil, MatchError{StatusCode: http.StatusConflict, Err: "Players already booked"}
 	}
-	res, err := tx.Exec("INSERT INTO matches (player1_id, player2_id, start_time, end_time, table_number) VALUES (?, ?, ?, ?, ?)", m.Player1id, m.Player2id, m.StartTime, m.EndTime, m.TableNumber)
-	tx.Commit()
 
-	return res, err
+	return res, nil
+}
+
+// checkBookings returns a conflict when another match that isn't deleted has
+// the table or the first player of m at its time.
+func (m Match) checkBookings(ctx context.Context, tx querier) error {
+	conflicts, err := selectMatchesWhere(ctx, tx, "SELECT "+matchColumns+" FROM matches WHERE id != ? AND table_number = ? AND ((start_time BETWEEN ? AND ?) OR (end_time BETWEEN ? AND ?)) AND deleted_at IS NULL", m.Id, m.TableNumber, m.StartTime, m.EndTime, m.StartTime, m.EndTime)
+	if err != nil {
+		return err
+	} else if len(conflicts) > 0 {
+		bookingConflicts.WithLabelValues("table").Inc()
+		return NewProblem(http.StatusConflict, "match.table_conflict", "Table already booked")
+	}
+	conflicts, err = selectMatchesWhere(ctx, tx, "SELECT "+matchColumns+" FROM matches WHERE id != ? AND (player1_id = ? OR player2_id = ?) AND ((start_time BETWEEN ? AND ?) OR (end_time BETWEEN ? AND ?)) AND deleted_at IS NULL", m.Id, m.Player1id, m.Player1id, m.StartTime, m.EndTime, m.StartTime, m.EndTime)
+	if err != nil {
+		return err
+	} else if len(conflicts) > 0 {
+		bookingConflicts.WithLabelValues("players").Inc()
+		return NewProblem(http.StatusConflict, "match.players_conflict", "Players already booked")
+	}
+	return nil
 }
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pool_db_query_duration_seconds",
+		Help:    "Duration of the database queries that select rows, by table.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"table"})
+	bookingConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_booking_conflicts_total",
+		Help: "Matches refused as their table or players were already booked.",
+	}, []string{"conflict"})
+	matchesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pool_matches_created_total",
+		Help: "Matches scheduled, whichever API they came from.",
+	})
+	resultsRecorded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pool_results_recorded_total",
+		Help: "Match results recorded or changed.",
+	})
+)
+
+// observeQuery times a query on table started at start, deferred as soon as
+// the query starts.
+func observeQuery(table string, start time.Time) {
+	queryDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
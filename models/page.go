@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// Page selects the slice of a list to return. Sort is one of the sortable
+// fields of the list, prefixed with "-" for descending order, and Cursor is
+// the one returned with the previous page.
+type Page struct {
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// Sortable is a row of a list that a page can continue after.
+type Sortable interface {
+	// SortKey returns the id of the row and its value of the sort field.
+	SortKey(field string) (int, any)
+}
+
+// cursor holds the sort value and id of the last row of a page, so the next
+// one continues after them whatever happened to that row since. Times are
+// kept apart to be read back as times rather than strings.
+type cursor struct {
+	Sort  string     `json:"sort"`
+	Id    int        `json:"id"`
+	Value any        `json:"value,omitempty"`
+	Time  *time.Time `json:"time,omitempty"`
+}
+
+// NextCursor returns the cursor of the page that follows the last row.
+func (p Page) NextCursor(last Sortable) string {
+	c := cursor{Sort: p.Sort}
+	field, _ := strings.CutPrefix(p.Sort, "-")
+	id, value := last.SortKey(field)
+	c.Id = id
+	if t, ok := value.(time.Time); ok {
+		c.Time = &t
+	} else {
+		c.Value = value
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sortColumn returns the column of a sort such as "name" or "-points", which
+// is by id when empty.
+func sortColumn(sortColumns map[string]string, sort string) (string, bool, error) {
+	field, descending := strings.CutPrefix(sort, "-")
+	if field == "" {
+		field = "id"
+	}
+	column, ok := sortColumns[field]
+	if !ok {
+		return "", false, NewProblem(http.StatusBadRequest, "request.invalid_sort", "Invalid sort field "+field)
+	}
+	return column, descending, nil
+}
+
+// selectPage completes a list query with the keyset condition, ordering and
+// limit of the page. sortColumns maps the sortable fields to their columns.
+func (p Page) selectPage(table string, columns string, sortColumns map[string]string, conditions []string, args []any) (string, []any, error) {
+	var after cursor
+
+	column, descending, err := sortColumn(sortColumns, p.Sort)
+	if err != nil {
+		return "", nil, err
+	}
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if p.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+		if err == nil {
+			err = json.Unmarshal(data, &after)
+		}
+		if err != nil || after.Sort != p.Sort {
+			return "", nil, NewProblem(http.StatusBadRequest, "request.invalid_cursor", "Invalid cursor")
+		}
+		last := after.Value
+		if after.Time != nil {
+			last = *after.Time
+		}
+		conditions = append(conditions, "("+column+" "+comparison+" ? OR ("+column+" = ? AND id > ?))")
+		args = append(args, last, last, after.Id)
+	}
+
+	limit := p.Limit
+	if limit <= 0 || limit > MaxPageLimit {
+		limit = DefaultPageLimit
+	}
+	query := "SELECT " + columns + " FROM " + table
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + column + " " + direction + ", id ASC LIMIT ?"
+
+	return query, append(args, limit), nil
+}
@@ -1,108 +1,315 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
+const playerColumns = "id, name, ranking, preferred_cue, profile_picture_url, COALESCE(points, 0), deleted_at, version"
+
 func CreatePlayersTable(dbConn *sql.DB) (sql.Result, error) {
-	return dbConn.Exec("CREATE TABLE IF NOT EXISTS players (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, ranking INTEGER, preferred_cue TEXT, profile_picture_url TEXT, points INTEGER)")
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS players (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, ranking INTEGER, preferred_cue TEXT, profile_picture_url TEXT, points INTEGER, deleted_at DATETIME, version INTEGER DEFAULT 1)")
+	if err != nil {
+		return nil, err
+	}
+	err = addColumnIfNotExists(dbConn, "players", "deleted_at", "DATETIME")
+	if err != nil {
+		return nil, err
+	}
+
+	return res, addColumnIfNotExists(dbConn, "players", "version", "INTEGER DEFAULT 1")
 }
 
-func SelectAllPlayers(dbConn *sql.DB) ([]Player, error) {
-	return selectPlayersWhere(dbConn, "SELECT * FROM players")
+func SelectAllPlayers(ctx context.Context, dbConn *sql.DB, includeDeleted bool) ([]Player, error) {
+	return selectPlayersWhere(ctx, dbConn, "SELECT "+playerColumns+" FROM players WHERE "+deletedFilter(includeDeleted))
 }
 
-func SelectPlayersByName(dbConn *sql.DB, name string) ([]Player, error) {
-	return selectPlayersWhere(dbConn, "SELECT * FROM players WHERE name LIKE '%"+name+"%'")
+// playerSortColumns are the fields players can be sorted by.
+var playerSortColumns = map[string]string{
+	"id":      "id",
+	"name":    "name",
+	"ranking": "COALESCE(ranking, 0)",
+	"points":  "COALESCE(points, 0)",
+}
+
+// PlayerFilter narrows the players returned by SelectPlayers.
+type PlayerFilter struct {
+	Name           string
+	IncludeDeleted bool
+}
+
+func (f PlayerFilter) conditions() ([]string, []any) {
+	var conditions = []string{deletedFilter(f.IncludeDeleted)}
+	var args []any
+
+	if f.Name != "" {
+		conditions = append(conditions, "name LIKE ?")
+		args = append(args, "%"+f.Name+"%")
+	}
+
+	return conditions, args
 }
 
-func SelectPlayerById(dbConn *sql.DB, id string) (Player, error) {
-	players, err := selectPlayersWhere(dbConn, "SELECT * FROM players WHERE id = "+id)
+func SelectPlayers(ctx context.Context, dbConn *sql.DB, filter PlayerFilter, page Page) ([]Player, error) {
+	conditions, args := filter.conditions()
+	query, args, err := page.selectPage("players", playerColumns, playerSortColumns, conditions, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectPlayersWhere(ctx, dbConn, query, args...)
+}
+
+// SelectPlayersByIds returns the players with the given ids in a single query,
+// including soft deleted ones, as they may still be referred to.
+func SelectPlayersByIds(ctx context.Context, dbConn *sql.DB, ids []int) ([]Player, error) {
+	if len(ids) == 0 {
+		return []Player{}, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	return selectPlayersWhere(ctx, dbConn, "SELECT "+playerColumns+" FROM players WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+}
+
+func SelectPlayersDeletedBefore(ctx context.Context, dbConn *sql.DB, cutoff time.Time) ([]Player, error) {
+	return selectPlayersWhere(ctx, dbConn, "SELECT "+playerColumns+" FROM players WHERE deleted_at < ?", cutoff.UTC())
+}
+
+func SelectPlayerById(ctx context.Context, dbConn querier, id string) (Player, error) {
+	players, err := selectPlayersWhere(ctx, dbConn, "SELECT "+playerColumns+" FROM players WHERE id = ? AND deleted_at IS NULL", id)
 	if err != nil {
 		return Player{}, err
 	} else if len(players) == 0 {
-		return Player{}, PlayerError{http.StatusNotFound, fmt.Sprintf("Player with id %s not found", id)}
+		return Player{}, NewProblem(http.StatusNotFound, "player.not_found", fmt.Sprintf("Player with id %s not found", id))
 	}
 
 	return players[0], nil
 }
 
-func selectPlayersWhere(dbConn *sql.DB, query string) ([]Player, error) {
+func selectPlayersWhere(ctx context.Context, dbConn querier, query string, args ...any) ([]Player, error) {
+	defer observeQuery("players", time.Now())
 	players := []Player{}
-	rows, err := dbConn.Query(query)
+	rows, err := dbConn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var player Player
-
-		rows.Scan(&player.Id, &player.Name, &player.Ranking, &player.PreferredCue, &player.ProfilePictureUrl, &player.Points)
+		player, err := scanPlayer(rows)
+		if err != nil {
+			return nil, err
+		}
 		players = append(players, player)
 	}
 
-	return players, nil
+	return players, rows.Err()
 }
 
-func UpdatePlayerById(dbConn *sql.DB, id string, player Player) (sql.Result, error) {
-	return dbConn.Exec("UPDATE players SET name = ?, ranking = ?, preferred_cue = ?, profile_picture_url = ?, points = ? WHERE id = ?", player.Name, player.Ranking, player.PreferredCue, player.ProfilePictureUrl, player.Points, id)
+// scanPlayer reads a row of playerColumns, followed by any extra columns.
+func scanPlayer(rows *sql.Rows, extra ...any) (Player, error) {
+	var player Player
+
+	err := rows.Scan(append([]any{&player.Id, &player.Name, &player.Ranking, &player.PreferredCue, &player.ProfilePictureUrl, &player.Points, &player.DeletedAt, &player.Version}, extra...)...)
+	return player, err
 }
 
-func DeletePlayerById(dbConn *sql.DB, id string) (sql.Result, error) {
-	return dbConn.Exec("DELETE FROM players WHERE id = ?", id)
+// UpdatePlayerById saves the player if it is still at player.Version, a zero
+// version skips the check, and records the change by actor in the audit log.
+// Its ranking and points are left to the match history.
+func UpdatePlayerById(ctx context.Context, dbConn *sql.DB, id string, player Player, actor string) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := SelectPlayerById(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE players SET name = ?, preferred_cue = ?, profile_picture_url = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?)", player.Name, player.PreferredCue, player.ProfilePictureUrl, id, player.Version, player.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPlayerVersion(res)
+	if err != nil {
+		return nil, err
+	}
+	after, err := SelectPlayerById(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = recordAudit(ctx, tx, actor, "player", id, "update", before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit()
 }
 
-func UpdatePoints(dbConn *sql.DB, winnerId int, loserId int) error {
-	var winner Player
-	var loser Player
-	var err error
-	winner, err = SelectPlayerById(dbConn, fmt.Sprintf("%d", winnerId))
+// DeletePlayerById soft deletes the player if it is still at version, it stays
+// restorable until it is purged. The change by actor is recorded in the audit
+// log.
+func DeletePlayerById(ctx context.Context, dbConn *sql.DB, id string, version int, actor string) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	loser, err = SelectPlayerById(dbConn, fmt.Sprintf("%d", loserId))
+	defer tx.Rollback()
+
+	before, err := SelectPlayerById(ctx, tx, id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE players SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)", time.Now().UTC(), id, version, version)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPlayerVersion(res)
+	if err != nil {
+		return nil, err
+	}
+	err = recordAudit(ctx, tx, actor, "player", id, "delete", before, nil)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("update points", winnerId, loserId)
 
-	return winner.win(dbConn, loser)
+	return res, tx.Commit()
 }
 
-type PlayerError struct {
-	StatusCode int
-	Err        string
+// RestorePlayerById restores the soft deleted player, and records the change
+// by actor in the audit log. No row is affected when the player isn't deleted.
+func RestorePlayerById(ctx context.Context, dbConn *sql.DB, id string, actor string) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE players SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return nil, err
+	} else if rowsAffected, err := res.RowsAffected(); err != nil || rowsAffected == 0 {
+		return res, err
+	}
+	after, err := SelectPlayerById(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = recordAudit(ctx, tx, actor, "player", id, "restore", nil, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit()
+}
+
+func checkPlayerVersion(res sql.Result) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return NewProblem(http.StatusPreconditionFailed, "player.modified", "Player was modified, get it again and retry")
+	}
+	return nil
 }
 
-func (e PlayerError) Error() string {
-	return e.Err
+func PurgePlayerById(ctx context.Context, dbConn *sql.DB, id string) (sql.Result, error) {
+	return dbConn.ExecContext(ctx, "DELETE FROM players WHERE id = ? AND deleted_at IS NOT NULL", id)
 }
 
 type Player struct {
 	Id                int    `json:"id" uri:"id"`
 	Name              string `json:"name" binding:"required"`
-	Ranking           int    `json:"ranking"` // 0 means no ranking, 1 means the best player
+	Ranking           int    `json:"ranking"` // 0 means no ranking, 1 means the best player. Read only
 	PreferredCue      string `json:"preferredCue"`
 	ProfilePictureUrl string `json:"profilePictureUrl"`
-	Points            int    `json:"points"` // 1 point for each win, 2 points for winning a better player
+	Points            int    `json:"points"` // 1 point for each win, 2 points for winning a better player. Read only
+
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	Version   int        `json:"version"` // incremented on every change, the ETag of the player
 }
 
-func (p Player) Create(dbConn *sql.DB) (sql.Result, error) {
-	return dbConn.Exec(
-		"INSERT INTO players (name, ranking, preferred_cue, profile_picture_url) VALUES (?, ?, ?, ?)",
-		p.Name, p.Ranking, p.PreferredCue, p.ProfilePictureUrl,
+// Create inserts the player unranked and without points, whatever p says, as
+// only the match history sets them.
+func (p Player) Create(ctx context.Context, dbConn querier) (sql.Result, error) {
+	return dbConn.ExecContext(ctx,
+		"INSERT INTO players (name, ranking, preferred_cue, profile_picture_url, points) VALUES (?, 0, ?, ?, 0)",
+		p.Name, p.PreferredCue, p.ProfilePictureUrl,
 	)
 }
 
-func (p Player) win(dbConn *sql.DB, loser Player) error {
-	if loser.Points > p.Points {
-		p.Points += 2
-	} else {
-		p.Points++
+// CreatePlayer saves a new player, with the profile picture URL pictureUrl
+// gives for its id and name, and records its creation by actor in the audit
+// log and its player.created event in the outbox in the same transaction. It
+// returns the player as saved.
+func CreatePlayer(ctx context.Context, dbConn *sql.DB, player Player, pictureUrl func(id int, name string) string, actor string) (Player, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return Player{}, err
 	}
-	_, err := UpdatePlayerById(dbConn, fmt.Sprintf("%d", p.Id), p)
+	defer tx.Rollback()
 
-	return err
+	player, err = createPlayer(ctx, tx, player, pictureUrl, actor)
+	if err != nil {
+		return Player{}, err
+	}
+
+	return player, tx.Commit()
+}
+
+// createPlayer inserts the player with its audit and webhook events, it must
+// run in a transaction so none is saved without the others.
+func createPlayer(ctx context.Context, tx querier, player Player, pictureUrl func(id int, name string) string, actor string) (Player, error) {
+	res, err := player.Create(ctx, tx)
+	if err != nil {
+		return Player{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Player{}, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE players SET profile_picture_url = ? WHERE id = ?", pictureUrl(int(id), player.Name), id)
+	if err != nil {
+		return Player{}, err
+	}
+	player, err = SelectPlayerById(ctx, tx, fmt.Sprintf("%d", id))
+	if err != nil {
+		return Player{}, err
+	}
+
+	err = recordAudit(ctx, tx, actor, "player", fmt.Sprintf("%d", player.Id), "create", nil, player)
+	if err != nil {
+		return Player{}, err
+	}
+
+	return player, EnqueueWebhookEvent(ctx, tx, WebhookPlayerCreated, player)
+}
+
+// WithStandingsOf returns p with the ranking and points of stored, the player
+// as saved. Clients can't set them, only the match history does.
+func (p Player) WithStandingsOf(stored Player) Player {
+	p.Ranking = stored.Ranking
+	p.Points = stored.Points
+	return p
+}
+
+// SortKey returns the id of p and its value of one of playerSortColumns.
+func (p Player) SortKey(field string) (int, any) {
+	switch field {
+	case "name":
+		return p.Id, p.Name
+	case "ranking":
+		return p.Id, p.Ranking
+	case "points":
+		return p.Id, p.Points
+	}
+	return p.Id, p.Id
 }
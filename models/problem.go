@@ -0,0 +1,32 @@
+package models
+
+import (
+	"net/http"
+)
+
+// Problem is an error meant for the API clients, rendered as an RFC 7807
+// problem detail. Code identifies the kind of problem for machines, Detail
+// explains this occurrence to humans.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Code   string       `json:"code"` // such as match.table_conflict or player.not_found
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError tells which field of the request failed which validation rule.
+type FieldError struct {
+	Field  string `json:"field"`
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+func NewProblem(status int, code string, detail string) Problem {
+	return Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Code: code, Detail: detail}
+}
+
+func (p Problem) Error() string {
+	return p.Detail
+}
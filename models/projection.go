@@ -0,0 +1,367 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ScoringRule decides how many points the winner of a match gets, given both
+// players' standings right before the result.
+type ScoringRule func(winner Standing, loser Standing) int
+
+// ScoringRules are the rules the projections can be built with, by name.
+var ScoringRules = map[string]ScoringRule{
+	"default": defaultScoring,
+	"flat":    func(winner Standing, loser Standing) int { return 1 },
+}
+
+// defaultScoring gives 1 point for each win, 2 points for winning a better
+// player.
+func defaultScoring(winner Standing, loser Standing) int {
+	if loser.Points > winner.Points {
+		return 2
+	}
+	return 1
+}
+
+// ScoringRuleByName returns the named rule, the default one when name is empty.
+func ScoringRuleByName(name string) (ScoringRule, error) {
+	if name == "" {
+		return defaultScoring, nil
+	} else if rule, ok := ScoringRules[name]; ok {
+		return rule, nil
+	}
+
+	return nil, fmt.Errorf("unknown scoring rule %q", name)
+}
+
+type Standing struct {
+	PlayerId int `json:"playerId"`
+	Ranking  int `json:"ranking"` // 0 means no ranking, 1 means the best player
+	Points   int `json:"points"`
+	Played   int `json:"played"`
+	Wins     int `json:"wins"`
+	Losses   int `json:"losses"`
+}
+
+type projectedMatch struct {
+	player1id int
+	player2id int
+	winnerId  int
+	cancelled bool
+	counted   bool // whether the result is currently part of the standings
+	loserId   int
+	awarded   int
+}
+
+// Projection folds the match history into player standings.
+type Projection struct {
+	rule      ScoringRule
+	standings map[int]*Standing
+	matches   map[int]*projectedMatch
+}
+
+func NewProjection(rule ScoringRule) *Projection {
+	if rule == nil {
+		rule = defaultScoring
+	}
+
+	return &Projection{rule: rule, standings: map[int]*Standing{}, matches: map[int]*projectedMatch{}}
+}
+
+// ReplayMatchEvents builds the projection from the whole match history.
+func ReplayMatchEvents(ctx context.Context, dbConn querier, rule ScoringRule) (*Projection, error) {
+	events, err := SelectMatchEvents(ctx, dbConn)
+	if err != nil {
+		return nil, err
+	}
+	projection := NewProjection(rule)
+	for _, event := range events {
+		projection.Apply(event)
+	}
+
+	return projection, nil
+}
+
+// RebuildProjections replays the match history under rule and overwrites the
+// points and rankings of every player with the result.
+func RebuildProjections(ctx context.Context, dbConn *sql.DB, rule ScoringRule) (*Projection, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	projection, err := ReplayMatchEvents(ctx, tx, rule)
+	if err != nil {
+		return nil, err
+	}
+	err = projection.saveStandings(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	for matchId := range projection.matches {
+		err = projection.saveAward(ctx, tx, matchId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return projection, tx.Commit()
+}
+
+// recordMatchEvent appends the event and applies it to the points and
+// rankings stored for the players, within the caller's transaction, once the
+// match itself was saved. Only the history of this match is read, the whole of
+// it is replayed by RebuildProjections.
+func recordMatchEvent(ctx context.Context, tx *sql.Tx, event MatchEvent, rule ScoringRule) error {
+	history, err := selectMatchEventsWhere(ctx, tx, "match_id = ?", event.MatchId)
+	if err != nil {
+		return err
+	}
+	_, err = event.Create(ctx, tx)
+	if err != nil {
+		return err
+	}
+	match, err := storedMatch(ctx, tx, event.MatchId, history)
+	if err != nil {
+		return err
+	}
+	stored, err := selectStoredStandings(ctx, tx, match.player1id, match.player2id, event.Player1id, event.Player2id)
+	if err != nil {
+		return err
+	}
+
+	projection := NewProjection(rule)
+	projection.matches[event.MatchId] = match
+	for id, standing := range stored {
+		projection.standings[id] = &Standing{PlayerId: id, Points: standing.Points}
+	}
+	projection.Apply(event)
+	for id, standing := range projection.standings {
+		// Apply only knows this match, whether they played comes from the others
+		standing.Played = stored[id].Played
+	}
+
+	ranked := map[int]bool{}
+	for _, standing := range projection.Standings() {
+		ranked[standing.PlayerId] = true
+		if standing.Points != stored[standing.PlayerId].Points || standing.Ranking != stored[standing.PlayerId].Ranking {
+			_, err = tx.ExecContext(ctx, "UPDATE players SET points = ?, ranking = ?, version = version + 1 WHERE id = ?", standing.Points, standing.Ranking, standing.PlayerId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for id, standing := range stored {
+		if !ranked[id] && (standing.Points != 0 || standing.Ranking != 0) {
+			_, err = tx.ExecContext(ctx, "UPDATE players SET points = 0, ranking = 0, version = version + 1 WHERE id = ?", id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return projection.saveAward(ctx, tx, event.MatchId)
+}
+
+// storedMatch folds the history of a match into how it stands in the stored
+// standings, with the points its result was awarded.
+func storedMatch(ctx context.Context, dbConn querier, matchId int, history []MatchEvent) (*projectedMatch, error) {
+	match := &projectedMatch{}
+	for _, event := range history {
+		match.player1id = event.Player1id
+		match.player2id = event.Player2id
+		match.winnerId = event.WinnerId
+		if event.Type == MatchCancelled {
+			match.cancelled = true
+		} else if event.Type == MatchRestored {
+			match.cancelled = false
+		}
+	}
+	if match.cancelled || match.winnerId == 0 {
+		return match, nil
+	}
+	match.counted = true
+	match.loserId = match.player1id
+	if match.winnerId == match.player1id {
+		match.loserId = match.player2id
+	}
+
+	rows, err := dbConn.QueryContext(ctx, "SELECT COALESCE(awarded_points, 0) FROM matches WHERE id = ?", matchId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&match.awarded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return match, rows.Err()
+}
+
+// selectStoredStandings returns the points and rankings stored for the ranked
+// players and for the players of a match, by id. Played is 1 for those with a
+// result that counts, 0 for the others.
+func selectStoredStandings(ctx context.Context, dbConn querier, matchPlayerIds ...int) (map[int]Standing, error) {
+	var standings = map[int]Standing{}
+	var placeholders []string
+	var args []any
+
+	for _, id := range matchPlayerIds {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	// The matches are already saved, so they tell whether the players of this
+	// one still have a result, ranked players of other matches do
+	query := "SELECT id, COALESCE(points, 0), COALESCE(ranking, 0), " +
+		"CASE WHEN id IN (" + strings.Join(placeholders, ", ") + ") THEN EXISTS (SELECT 1 FROM matches WHERE player1_id = players.id AND deleted_at IS NULL AND COALESCE(winner_id, 0) != 0) OR EXISTS (SELECT 1 FROM matches WHERE player2_id = players.id AND deleted_at IS NULL AND COALESCE(winner_id, 0) != 0) ELSE 1 END " +
+		"FROM players WHERE COALESCE(ranking, 0) != 0 OR id IN (" + strings.Join(placeholders, ", ") + ")"
+	rows, err := dbConn.QueryContext(ctx, query, append(args[:len(args):len(args)], args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var standing Standing
+
+		err = rows.Scan(&standing.PlayerId, &standing.Points, &standing.Ranking, &standing.Played)
+		if err != nil {
+			return nil, err
+		}
+		standings[standing.PlayerId] = standing
+	}
+
+	return standings, rows.Err()
+}
+
+func (p *Projection) Apply(event MatchEvent) {
+	match, ok := p.matches[event.MatchId]
+	if !ok {
+		match = &projectedMatch{}
+		p.matches[event.MatchId] = match
+	}
+	cancelled := match.cancelled
+	if event.Type == MatchCancelled {
+		cancelled = true
+	} else if event.Type == MatchRestored {
+		cancelled = false
+	}
+	if match.player1id == event.Player1id && match.player2id == event.Player2id && match.winnerId == event.WinnerId && match.cancelled == cancelled {
+		return
+	}
+
+	p.revoke(match)
+	match.player1id = event.Player1id
+	match.player2id = event.Player2id
+	match.winnerId = event.WinnerId
+	match.cancelled = cancelled
+	p.award(match)
+}
+
+// Standings returns every player that played a counted match, best first.
+func (p *Projection) Standings() []Standing {
+	standings := []Standing{}
+	for _, standing := range p.standings {
+		if standing.Played > 0 {
+			standings = append(standings, *standing)
+		}
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Points != standings[j].Points {
+			return standings[i].Points > standings[j].Points
+		}
+		return standings[i].PlayerId < standings[j].PlayerId
+	})
+	for i := range standings {
+		if i > 0 && standings[i].Points == standings[i-1].Points {
+			standings[i].Ranking = standings[i-1].Ranking
+		} else {
+			standings[i].Ranking = i + 1
+		}
+	}
+
+	return standings
+}
+
+func (p *Projection) standing(playerId int) *Standing {
+	standing, ok := p.standings[playerId]
+	if !ok {
+		standing = &Standing{PlayerId: playerId}
+		p.standings[playerId] = standing
+	}
+
+	return standing
+}
+
+func (p *Projection) award(match *projectedMatch) {
+	if match.cancelled || match.winnerId == 0 {
+		return
+	}
+	match.loserId = match.player1id
+	if match.winnerId == match.player1id {
+		match.loserId = match.player2id
+	}
+	winner := p.standing(match.winnerId)
+	loser := p.standing(match.loserId)
+
+	match.awarded = p.rule(*winner, *loser)
+	match.counted = true
+	winner.Points += match.awarded
+	winner.Wins++
+	winner.Played++
+	loser.Losses++
+	loser.Played++
+}
+
+func (p *Projection) revoke(match *projectedMatch) {
+	if !match.counted {
+		return
+	}
+	winner := p.standing(match.winnerId)
+	loser := p.standing(match.loserId)
+
+	winner.Points -= match.awarded
+	winner.Wins--
+	winner.Played--
+	loser.Losses--
+	loser.Played--
+	match.counted = false
+	match.awarded = 0
+}
+
+// saveStandings writes the points and rankings to the players. Only the
+// players whose values change get a new version.
+func (p *Projection) saveStandings(ctx context.Context, dbConn querier) error {
+	var err error
+	var ranked = []string{}
+	var args = []any{}
+
+	for _, standing := range p.Standings() {
+		_, err = dbConn.ExecContext(ctx, "UPDATE players SET points = ?, ranking = ?, version = version + 1 WHERE id = ? AND (COALESCE(points, 0) != ? OR COALESCE(ranking, 0) != ?)", standing.Points, standing.Ranking, standing.PlayerId, standing.Points, standing.Ranking)
+		if err != nil {
+			return err
+		}
+		ranked = append(ranked, "?")
+		args = append(args, standing.PlayerId)
+	}
+	_, err = dbConn.ExecContext(ctx, "UPDATE players SET points = 0, ranking = 0, version = version + 1 WHERE (COALESCE(points, 0) != 0 OR COALESCE(ranking, 0) != 0) AND id NOT IN ("+strings.Join(ranked, ", ")+")", args...)
+
+	return err
+}
+
+func (p *Projection) saveAward(ctx context.Context, dbConn querier, matchId int) error {
+	var awarded int
+	if match, ok := p.matches[matchId]; ok {
+		awarded = match.awarded
+	}
+	_, err := dbConn.ExecContext(ctx, "UPDATE matches SET awarded_points = ? WHERE id = ?", awarded, matchId)
+
+	return err
+}
@@ -0,0 +1,58 @@
+package models
+
+// Roles of the users. Users sign up as players, an admin gives them any other
+// role.
+const (
+	RoleAdmin     = "admin"
+	RoleOrganiser = "organiser"
+	RoleReferee   = "referee"
+	RolePlayer    = "player"
+)
+
+// Permissions, named after what they allow to read or change. Reading is open
+// to anyone but the audit log, the read permissions only limit what API keys
+// read.
+const (
+	PermissionPlayersRead    = "players:read"
+	PermissionMatchesRead    = "matches:read"
+	PermissionPlayersCreate  = "players:create"
+	PermissionPlayersUpdate  = "players:update"
+	PermissionPlayersDelete  = "players:delete"
+	PermissionProfileUpdate  = "profile:update" // the preferred cue of the user's own player only
+	PermissionMatchesCreate  = "matches:create"
+	PermissionMatchesUpdate  = "matches:update" // who plays, when and where
+	PermissionMatchesDelete  = "matches:delete"
+	PermissionResultsWrite   = "results:write" // the winner and the end time
+	PermissionClaimsDecide   = "claims:decide"
+	PermissionAuditRead      = "audit:read"   // holds snapshots of users, claims and API keys
+	PermissionDeletedRead    = "deleted:read" // soft deleted players and matches, for admins only
+	PermissionWebhooksManage = "webhooks:manage"
+	PermissionUsersManage    = "users:manage"
+	PermissionApiKeysManage  = "apikeys:manage"
+)
+
+// rolePermissions are what every role but admin may do, admins may do
+// anything.
+var rolePermissions = map[string][]string{
+	RoleOrganiser: {
+		PermissionPlayersRead, PermissionMatchesRead,
+		PermissionPlayersCreate, PermissionPlayersUpdate, PermissionPlayersDelete,
+		PermissionMatchesCreate, PermissionMatchesUpdate, PermissionMatchesDelete,
+		PermissionClaimsDecide, PermissionAuditRead,
+	},
+	RoleReferee: {PermissionPlayersRead, PermissionMatchesRead, PermissionResultsWrite},
+	RolePlayer:  {PermissionPlayersRead, PermissionMatchesRead, PermissionProfileUpdate},
+}
+
+// HasPermission tells whether users with role may do what permission allows.
+func HasPermission(role string, permission string) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = NewProblem(http.StatusUnauthorized, "auth.invalid_credentials", "Email or password is wrong")
+
+// dummyHash is compared against when the email is unknown, so a login takes
+// as long whether the user exists or not.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+const userColumns = "id, email, password_hash, role, player_id, created_at"
+
+func CreateUsersTable(dbConn *sql.DB) (sql.Result, error) {
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL UNIQUE, password_hash TEXT NOT NULL, role TEXT DEFAULT 'player', player_id INTEGER, created_at DATETIME)")
+	if err != nil {
+		return nil, err
+	}
+	err = addColumnIfNotExists(dbConn, "users", "role", "TEXT DEFAULT 'player'")
+	if err != nil {
+		return nil, err
+	}
+
+	return res, addColumnIfNotExists(dbConn, "users", "player_id", "INTEGER")
+}
+
+// User is an account that can sign in. Only the bcrypt hash of its password is
+// stored.
+type User struct {
+	Id           int       `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	PlayerId     *int      `json:"playerId,omitempty"` // the player the user is, whose profile it may edit
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// UserAccess is what an admin decides about a user.
+type UserAccess struct {
+	Role     string `json:"role" binding:"required,oneof=admin organiser referee player"`
+	PlayerId *int   `json:"playerId"`
+}
+
+// Credentials are what a user signs up or in with. Bcrypt ignores anything
+// past 72 bytes, so longer passwords are refused rather than truncated.
+type Credentials struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NewUser returns a user for credentials with the password hashed.
+func NewUser(credentials Credentials) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Email: normalizeEmail(credentials.Email), PasswordHash: string(hash), Role: RolePlayer}, nil
+}
+
+func (u *User) Create(ctx context.Context, dbConn *sql.DB) (sql.Result, error) {
+	u.CreatedAt = time.Now().UTC()
+	res, err := dbConn.ExecContext(ctx, "INSERT OR IGNORE INTO users (email, password_hash, role, player_id, created_at) VALUES (?, ?, ?, ?, ?)", u.Email, u.PasswordHash, u.Role, u.PlayerId, u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	} else if rowsAffected == 0 {
+		return nil, NewProblem(http.StatusConflict, "user.email_taken", "A user with this email already exists")
+	}
+	id, err := res.LastInsertId()
+	u.Id = int(id)
+
+	return res, err
+}
+
+func SelectUsers(ctx context.Context, dbConn *sql.DB) ([]User, error) {
+	return selectUsersWhere(ctx, dbConn, "1 = 1 ORDER BY id")
+}
+
+func SelectUserById(ctx context.Context, dbConn *sql.DB, id int) (User, error) {
+	users, err := selectUsersWhere(ctx, dbConn, "id = ?", id)
+	if err != nil {
+		return User{}, err
+	} else if len(users) == 0 {
+		return User{}, NewProblem(http.StatusNotFound, "user.not_found", fmt.Sprintf("User with id %d not found", id))
+	}
+	return users[0], nil
+}
+
+func SelectUserByEmail(ctx context.Context, dbConn *sql.DB, email string) (User, error) {
+	users, err := selectUsersWhere(ctx, dbConn, "email = ?", normalizeEmail(email))
+	if err != nil {
+		return User{}, err
+	} else if len(users) == 0 {
+		return User{}, NewProblem(http.StatusNotFound, "user.not_found", fmt.Sprintf("User with email %s not found", email))
+	}
+	return users[0], nil
+}
+
+// UpdateUserAccess gives the user with id a role and the player it is, if
+// any, and records the change by actor in the audit log.
+func UpdateUserAccess(ctx context.Context, dbConn *sql.DB, id int, access UserAccess, actor string) error {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	users, err := selectUsersWhere(ctx, tx, "id = ?", id)
+	if err != nil {
+		return err
+	} else if len(users) == 0 {
+		return NewProblem(http.StatusNotFound, "user.not_found", fmt.Sprintf("User with id %d not found", id))
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET role = ?, player_id = ? WHERE id = ?", access.Role, access.PlayerId, id)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(ctx, tx, actor, "user", fmt.Sprintf("%d", id), "update", UserAccess{Role: users[0].Role, PlayerId: users[0].PlayerId}, access)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AuthenticateUser returns the user the credentials belong to. A wrong email
+// and a wrong password fail the same way, so emails can't be probed.
+func AuthenticateUser(ctx context.Context, dbConn *sql.DB, credentials Credentials) (User, error) {
+	users, err := selectUsersWhere(ctx, dbConn, "email = ?", normalizeEmail(credentials.Email))
+	if err != nil {
+		return User{}, err
+	}
+	hash := dummyHash
+	if len(users) > 0 {
+		hash = []byte(users[0].PasswordHash)
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(credentials.Password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || len(users) == 0 {
+		return User{}, errInvalidCredentials
+	} else if err != nil {
+		return User{}, err
+	}
+	return users[0], nil
+}
+
+func selectUsersWhere(ctx context.Context, dbConn querier, condition string, args ...any) ([]User, error) {
+	defer observeQuery("users", time.Now())
+	users := []User{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT "+userColumns+" FROM users WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+
+		err = rows.Scan(&user.Id, &user.Email, &user.PasswordHash, &user.Role, &user.PlayerId, &user.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
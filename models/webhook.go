@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Webhook events, named after what happened.
+const (
+	WebhookPlayerCreated       = "player.created"
+	WebhookMatchScheduled      = "match.scheduled"
+	WebhookMatchResultRecorded = "match.result_recorded"
+)
+
+// Delivery statuses. Deliveries are pending until they succeed or run out of
+// attempts, then they are dead until replayed by hand.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+func CreateWebhooksTable(dbConn *sql.DB) (sql.Result, error) {
+	res, err := dbConn.Exec("CREATE TABLE IF NOT EXISTS webhooks (id INTEGER PRIMARY KEY AUTOINCREMENT, url TEXT, secret TEXT, events TEXT, created_at DATETIME)")
+	if err != nil {
+		return nil, err
+	}
+	// The outbox, every event waits here until its subscriber got it
+	_, err = dbConn.Exec("CREATE TABLE IF NOT EXISTS webhook_deliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, webhook_id INTEGER, event TEXT, payload TEXT, status TEXT, attempts INTEGER DEFAULT 0, next_attempt_at DATETIME, last_error TEXT, created_at DATETIME)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec("CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)")
+
+	return res, err
+}
+
+// Webhook subscribes a URL to some events. Deliveries are signed with Secret,
+// which is only shown when the webhook is created.
+type Webhook struct {
+	Id        int       `json:"id"`
+	Url       string    `json:"url" binding:"required,url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events" binding:"required,min=1,dive,oneof=player.created match.scheduled match.result_recorded"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (w *Webhook) Create(ctx context.Context, dbConn *sql.DB) (sql.Result, error) {
+	w.CreatedAt = time.Now().UTC()
+	res, err := dbConn.ExecContext(ctx,
+		"INSERT INTO webhooks (url, secret, events, created_at) VALUES (?, ?, ?, ?)",
+		w.Url, w.Secret, strings.Join(w.Events, ","), w.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	w.Id = int(id)
+
+	return res, err
+}
+
+func SelectWebhooks(ctx context.Context, dbConn *sql.DB) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT id, url, events, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+
+		err = rows.Scan(&webhook.Id, &webhook.Url, &events, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhookById deletes the webhook along with its deliveries, at once so
+// no delivery is left without its webhook.
+func DeleteWebhookById(ctx context.Context, dbConn *sql.DB, id string) (sql.Result, error) {
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit()
+}
+
+// WebhookDelivery is an event on its way to a webhook.
+type WebhookDelivery struct {
+	Id            int             `json:"id"`
+	WebhookId     int             `json:"webhookId"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload" swaggertype:"object"`
+	Status        string          `json:"status"` // pending, delivered or dead
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+
+	Url    string `json:"-"` // of the webhook, where the delivery goes
+	Secret string `json:"-"` // of the webhook, that signs the delivery
+}
+
+// EnqueueWebhookEvent puts the event in the outbox of every webhook subscribed
+// to it. The payload is built once, so every subscriber gets the same one.
+func EnqueueWebhookEvent(ctx context.Context, dbConn querier, event string, data any) error {
+	now := time.Now().UTC()
+	payload, err := json.Marshal(map[string]any{"event": event, "occurredAt": now, "data": data})
+	if err != nil {
+		return err
+	}
+	_, err = dbConn.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, last_error, created_at) "+
+			"SELECT id, ?, ?, ?, 0, ?, '', ? FROM webhooks WHERE ',' || events || ',' LIKE ?",
+		event, string(payload), DeliveryPending, now, now, "%,"+event+",%",
+	)
+
+	return err
+}
+
+const deliveryColumns = "d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_error, d.created_at, w.url, w.secret"
+
+// SelectDueDeliveries returns at most limit pending deliveries whose next
+// attempt is due, oldest first.
+func SelectDueDeliveries(ctx context.Context, dbConn *sql.DB, now time.Time, limit int) ([]WebhookDelivery, error) {
+	return selectDeliveriesWhere(ctx, dbConn, "d.status = ? AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?", DeliveryPending, now.UTC(), limit)
+}
+
+// SelectDeliveries returns the deliveries with status, all of them when
+// status is empty.
+func SelectDeliveries(ctx context.Context, dbConn *sql.DB, status string) ([]WebhookDelivery, error) {
+	return selectDeliveriesWhere(ctx, dbConn, "(? = '' OR d.status = ?) ORDER BY d.id", status, status)
+}
+
+func selectDeliveriesWhere(ctx context.Context, dbConn *sql.DB, condition string, args ...any) ([]WebhookDelivery, error) {
+	defer observeQuery("webhook_deliveries", time.Now())
+	deliveries := []WebhookDelivery{}
+	rows, err := dbConn.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+
+		err = rows.Scan(&delivery.Id, &delivery.WebhookId, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastError, &delivery.CreatedAt, &delivery.Url, &delivery.Secret)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func MarkDeliveryDelivered(ctx context.Context, dbConn *sql.DB, id int) (sql.Result, error) {
+	return dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, last_error = '' WHERE id = ?", DeliveryDelivered, id)
+}
+
+// MarkDeliveryFailed records a failed attempt, the delivery is tried again at
+// nextAttemptAt or, when it has none left, is dead.
+func MarkDeliveryFailed(ctx context.Context, dbConn *sql.DB, id int, deliveryErr error, nextAttemptAt time.Time, dead bool) (sql.Result, error) {
+	status := DeliveryPending
+	if dead {
+		status = DeliveryDead
+	}
+	return dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?", status, nextAttemptAt.UTC(), deliveryErr.Error(), id)
+}
+
+// ReplayDelivery sends a dead delivery again, with a fresh set of attempts.
+func ReplayDelivery(ctx context.Context, dbConn *sql.DB, id string) error {
+	res, err := dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?", DeliveryPending, time.Now().UTC(), id, DeliveryDead)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return NewProblem(http.StatusNotFound, "webhook.delivery_not_found", fmt.Sprintf("Dead delivery with id %s not found", id))
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/m/v2/handlers"
+	"example.com/m/v2/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// maxPrepareWait is the longest delay between two attempts to prepare the
+// dependencies.
+const maxPrepareWait = 30 * time.Second
+
+// serve serves the REST and gRPC APIs and runs the background jobs until ctx
+// is done or a server fails. It prepares the dependencies meanwhile, /readyz
+// tells once they are. It then shuts down: the servers drain the requests in
+// flight while the jobs finish their round, for conf.ShutdownTimeout at most,
+// and the storage client and the database are closed.
+func serve(ctx context.Context, h handlers.Handler, conf Config, dbConn *sql.DB) error {
+	server := &http.Server{
+		Addr:         conf.ListenAddr,
+		Handler:      setupRouter(h),
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+	var grpcOptions []grpc.ServerOption
+	if conf.TlsCertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(conf.TlsCertFile, conf.TlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load TLS certificate: %w", err)
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(creds))
+	}
+	grpcServer := handlers.NewGrpcServer(h, grpcOptions...)
+
+	// gRPC listens on the same host as REST, on its own port
+	host, _, err := net.SplitHostPort(conf.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("could not parse listen address: %w", err)
+	}
+	listener, err := net.Listen("tcp", conf.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("could not listen for REST: %w", err)
+	}
+	grpcListener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(conf.GrpcPort)))
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("could not listen for gRPC: %w", err)
+	}
+
+	// Servers
+	stopped := make(chan error, 2)
+	go func() {
+		var err error
+		if conf.TlsCertFile != "" {
+			err = server.ServeTLS(listener, conf.TlsCertFile, conf.TlsKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		stopped <- err
+	}()
+	go func() {
+		stopped <- grpcServer.Serve(grpcListener)
+	}()
+	slog.Info("Serving", "rest", listener.Addr().String(), "grpc", grpcListener.Addr().String(), "tls", conf.TlsCertFile != "")
+
+	// Jobs, with a context of their own as they stop on shutdown only
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	running := map[string]chan struct{}{}
+	runJob := func(name string, job func()) {
+		done := make(chan struct{})
+		running[name] = done
+		go func() {
+			defer close(done)
+			job()
+		}()
+	}
+	runJob("purge", func() {
+		// Until the dependencies are ready, the API serves degraded and isn't ready
+		if prepareDependencies(jobs, h) {
+			purgeDeletedPeriodically(jobs, h, conf.PurgeRetention)
+		}
+	})
+	runJob("webhook deliveries", func() {
+		deliverWebhooksPeriodically(jobs, h)
+	})
+
+	select {
+	case <-ctx.Done():
+	case err = <-stopped:
+		if err == nil {
+			err = errors.New("server stopped")
+		}
+		err = fmt.Errorf("could not serve: %w", err)
+	}
+	slog.Info("Shutting down")
+
+	// Live streams never end on their own, they would hold up the shutdown
+	h.Hub.Close()
+	// The jobs finish their round while the servers drain
+	stopJobs()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(grpcStopped)
+	}()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		// Requests still in flight are cut short
+		err = errors.Join(err, fmt.Errorf("could not drain REST requests: %w", shutdownErr))
+		server.Close()
+	}
+	select {
+	case <-grpcStopped:
+	case <-shutdownCtx.Done():
+		err = errors.Join(err, errors.New("could not drain gRPC requests"))
+		grpcServer.Stop()
+	}
+
+	for name, done := range running {
+		select {
+		case <-done:
+		case <-shutdownCtx.Done():
+		}
+		select {
+		case <-done:
+		default:
+			// Its work is left for the next start, the outbox keeps the deliveries
+			slog.Warn("Job abandoned", "job", name)
+			err = errors.Join(err, fmt.Errorf("could not finish the %s job", name))
+		}
+	}
+	h.CloseStorage()
+	if closeErr := dbConn.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("could not close database: %w", closeErr))
+	}
+	return err
+}
+
+// prepareDependencies migrates the database and creates the bucket, retrying
+// with a growing delay until both succeed. It returns false when ctx is done
+// first.
+func prepareDependencies(ctx context.Context, h handlers.Handler) bool {
+	var migrated bool
+	wait := time.Second
+
+	for {
+		var err error
+		if !migrated {
+			err = models.Migrate(h.DbConn)
+			migrated = err == nil
+		}
+		if migrated {
+			err = h.CreateBucket(ctx)
+			if err == nil {
+				slog.Info("Dependencies ready")
+				return true
+			}
+			err = fmt.Errorf("could not create bucket: %w", err)
+		}
+		slog.Warn("Dependencies not ready", "retry_in", wait.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, maxPrepareWait)
+	}
+}